@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// Conditions of alert rules
+const (
+	// Current temperature below threshold
+	AlertBelow = "below"
+	// Current temperature above threshold
+	AlertAbove = "above"
+	// Current temperature not reaching target temperature within a delay
+	AlertTargetNotReached = "target_not_reached"
+	// No reading of the room received for a delay, the sensor may be disconnected
+	AlertStale = "stale"
+)
+
+// States of alert events
+const (
+	AlertRaised  = "raised"
+	AlertCleared = "cleared"
+)
+
+// DefaultAlertHysteresis is the margin in °C a temperature must move back past a threshold to clear an alert
+const DefaultAlertHysteresis = 0.5
+
+// DefaultMaxPendingAlerts is the number of alert events kept while they can't be published, oldest ones are dropped
+const DefaultMaxPendingAlerts = 100
+
+// AlertRule raises alerts on matching rooms, conditions are disabled when not set
+type AlertRule struct {
+	Name string
+	// Room ids or names, all rooms when empty
+	Rooms []string
+	Below *float32
+	Above *float32
+	// Margin in °C used to clear below, above and target_not_reached alerts, and tolerance to reach the target
+	Hysteresis   float32
+	TargetWithin time.Duration
+	StaleAfter   time.Duration
+}
+
+// Matches return true if rule applies to room
+func (r *AlertRule) Matches(room *warmup4ie.Room) bool {
+	if len(r.Rooms) == 0 {
+		return true
+	}
+	for _, value := range r.Rooms {
+		if value == strconv.Itoa(room.Id) || Slug(value) == Slug(room.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled return true if condition is set on rule
+func (r *AlertRule) enabled(condition string) bool {
+	switch condition {
+	case AlertBelow:
+		return r.Below != nil
+	case AlertAbove:
+		return r.Above != nil
+	case AlertTargetNotReached:
+		return r.TargetWithin > 0
+	case AlertStale:
+		return r.StaleAfter > 0
+	}
+	return false
+}
+
+// Alert is a raised or cleared alert of a room, sent in alert events
+type Alert struct {
+	Rule      string `json:"rule"`
+	Condition string `json:"condition"`
+	State     string `json:"state"`
+	// Current temperature of the room
+	Value float32 `json:"value"`
+	// Threshold of below and above alerts, target temperature of target_not_reached alerts
+	Threshold *float32 `json:"threshold,omitempty"`
+	// Start of the condition
+	Since time.Time `json:"since"`
+}
+
+// Alerts evaluate alert rules on each poll of an account and keep the state of alerts between polls.
+// Rooms missing from a poll are only evaluated by stale conditions, their other alerts keep their state
+// until the room is polled again.
+type Alerts struct {
+	Rules  []AlertRule
+	states map[alertKey]*alertState
+	// Last reading of rooms by id
+	readings map[int]roomReading
+}
+
+type alertKey struct {
+	rule      string
+	condition string
+	room      int
+}
+
+type alertState struct {
+	// Start of the condition
+	since  time.Time
+	raised bool
+	// Target temperature when the condition started, used by target_not_reached
+	target float32
+}
+
+// roomReading is a room returned by a poll and the time of the poll
+type roomReading struct {
+	room warmup4ie.Room
+	at   time.Time
+}
+
+func NewAlerts(rules []AlertRule) *Alerts {
+	return &Alerts{Rules: rules}
+}
+
+// SetRules replace rules, states of removed rules and conditions are dropped without clearing them
+func (a *Alerts) SetRules(rules []AlertRule) {
+	a.Rules = rules
+	enabled := make(map[string]*AlertRule, len(rules))
+	for i := range rules {
+		enabled[rules[i].Name] = &rules[i]
+	}
+	for key := range a.states {
+		if rule, ok := enabled[key.rule]; !ok || !rule.enabled(key.condition) {
+			delete(a.states, key)
+		}
+	}
+}
+
+// Evaluate rules on polled rooms, return events of raised and cleared alerts
+func (a *Alerts) Evaluate(account string, rooms []warmup4ie.Room, timestamp time.Time) []*Event {
+	if a.states == nil {
+		a.states = make(map[alertKey]*alertState)
+		a.readings = make(map[int]roomReading)
+	}
+	var events []*Event
+	for i := range rooms {
+		room := &rooms[i]
+		a.readings[room.Id] = roomReading{room: *room, at: timestamp}
+		current := room.CurrentTemp.GetValue()
+		target := room.TargetTemp.GetValue()
+		event := func(key alertKey, state *alertState, name string, threshold *float32) {
+			events = append(events, newAlertEvent(account, room, key, state, name, threshold, timestamp))
+		}
+		for j := range a.Rules {
+			rule := &a.Rules[j]
+			if !rule.Matches(room) {
+				continue
+			}
+			key := func(condition string) alertKey {
+				return alertKey{rule: rule.Name, condition: condition, room: room.Id}
+			}
+			if rule.Below != nil {
+				k := key(AlertBelow)
+				limit := *rule.Below
+				if a.raised(k) {
+					limit += rule.Hysteresis
+				}
+				if state, name := a.update(k, current < limit, 0, timestamp); name != "" {
+					event(k, state, name, rule.Below)
+				}
+			}
+			if rule.Above != nil {
+				k := key(AlertAbove)
+				limit := *rule.Above
+				if a.raised(k) {
+					limit -= rule.Hysteresis
+				}
+				if state, name := a.update(k, current > limit, 0, timestamp); name != "" {
+					event(k, state, name, rule.Above)
+				}
+			}
+			if rule.TargetWithin > 0 {
+				k := key(AlertTargetNotReached)
+				if state, ok := a.states[k]; ok && state.target != target {
+					// New target, the delay starts again
+					if state, name := a.update(k, false, 0, timestamp); name != "" {
+						event(k, state, name, &state.target)
+					}
+				}
+				// Raised below the tolerance, cleared once the target is reached
+				limit := target - rule.Hysteresis
+				if a.raised(k) {
+					limit += rule.Hysteresis
+				}
+				if state, name := a.update(k, current < limit, rule.TargetWithin, timestamp); state != nil {
+					if state.since.Equal(timestamp) {
+						state.target = target
+					}
+					if name != "" {
+						event(k, state, name, &state.target)
+					}
+				}
+			}
+		}
+	}
+	return append(events, a.evaluateStale(account, timestamp)...)
+}
+
+// evaluateStale raise stale alerts of rooms without reading for the delay of rules, including rooms missing from the poll
+func (a *Alerts) evaluateStale(account string, timestamp time.Time) []*Event {
+	ids := make([]int, 0, len(a.readings))
+	for id := range a.readings {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var events []*Event
+	for _, id := range ids {
+		reading := a.readings[id]
+		room := &reading.room
+		for j := range a.Rules {
+			rule := &a.Rules[j]
+			if rule.StaleAfter <= 0 || !rule.Matches(room) {
+				continue
+			}
+			k := alertKey{rule: rule.Name, condition: AlertStale, room: id}
+			if state, name := a.update(k, timestamp.Sub(reading.at) >= rule.StaleAfter, 0, timestamp); name != "" {
+				state.since = reading.at
+				events = append(events, newAlertEvent(account, room, k, state, name, nil, timestamp))
+			}
+		}
+	}
+	return events
+}
+
+// newAlertEvent return event of alert raised or cleared on room, value is the last current temperature of room
+func newAlertEvent(account string, room *warmup4ie.Room, key alertKey, state *alertState, name string, threshold *float32, timestamp time.Time) *Event {
+	return &Event{
+		Event:   EventAlert,
+		Account: account,
+		Room:    NewRoomState(room, timestamp),
+		Alert: &Alert{
+			Rule:      key.rule,
+			Condition: key.condition,
+			State:     name,
+			Value:     room.CurrentTemp.GetValue(),
+			Threshold: threshold,
+			Since:     state.since.UTC(),
+		},
+		Timestamp: timestamp.UTC(),
+	}
+}
+
+func (a *Alerts) raised(key alertKey) bool {
+	state, ok := a.states[key]
+	return ok && state.raised
+}
+
+// update state of alert with the condition of a poll, the alert is raised when condition is true for delay.
+// Return the state of alert, and the new state name when the alert is raised or cleared.
+func (a *Alerts) update(key alertKey, condition bool, delay time.Duration, timestamp time.Time) (*alertState, string) {
+	state, ok := a.states[key]
+	if !condition {
+		delete(a.states, key)
+		if ok && state.raised {
+			return state, AlertCleared
+		}
+		return nil, ""
+	}
+	if !ok {
+		state = &alertState{since: timestamp}
+		a.states[key] = state
+	}
+	if !state.raised && timestamp.Sub(state.since) >= delay {
+		state.raised = true
+		return state, AlertRaised
+	}
+	return state, ""
+}
+
+// publishAlert publish alert event after the ones not published yet.
+// Events are kept until published, a raised or cleared alert is not lost when broker is unavailable.
+func (m *Monitor) publishAlert(event *Event) error {
+	m.pendingAlerts = append(m.pendingAlerts, event)
+	if dropped := len(m.pendingAlerts) - DefaultMaxPendingAlerts; dropped > 0 {
+		log.Printf("%s%d alert events dropped, too many pending events\n", m.logPrefix(), dropped)
+		m.pendingAlerts = m.pendingAlerts[dropped:]
+	}
+	return m.publishPendingAlerts()
+}
+
+// publishPendingAlerts publish alert events not published yet in order, stop on first publication failure
+func (m *Monitor) publishPendingAlerts() error {
+	for len(m.pendingAlerts) > 0 {
+		event := m.pendingAlerts[0]
+		topic, payload, err := m.alertMessage(event)
+		if err != nil {
+			// Event can't be published on next poll either
+			log.Printf("%salert event dropped: %v\n", m.logPrefix(), err)
+		} else if err := m.publish(topic, payload, &mqttdevice.Properties{ContentType: "application/json"}); err != nil {
+			return err
+		}
+		m.pendingAlerts = m.pendingAlerts[1:]
+	}
+	m.pendingAlerts = nil
+	return nil
+}
+
+// alertMessage return alerts topic of event room and json of event
+func (m *Monitor) alertMessage(event *Event) (string, string, error) {
+	room := warmup4ie.Room{
+		Id:           event.Room.Id,
+		Name:         event.Room.Name,
+		LocationId:   event.Room.Location.Id,
+		LocationName: event.Room.Location.Name,
+	}
+	topic, err := m.Topics.AlertsTopic(&room)
+	if err != nil {
+		return "", "", err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return "", "", err
+	}
+	return topic, string(payload), nil
+}
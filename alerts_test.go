@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+func alertRoom(id int, name string, current float32, target float32) warmup4ie.Room {
+	return warmup4ie.Room{
+		Id:          id,
+		Name:        name,
+		CurrentTemp: warmup4ie.Temperature{RawTemperature: int(current*10 + 0.5)},
+		TargetTemp:  warmup4ie.Temperature{RawTemperature: int(target*10 + 0.5)},
+	}
+}
+
+// alertStates return rule, condition and state of alert events
+func alertStates(events []*Event) string {
+	var states []string
+	for _, event := range events {
+		states = append(states, event.Alert.Rule+" "+event.Alert.Condition+" "+event.Alert.State)
+	}
+	return strings.Join(states, ",")
+}
+
+func TestAlerts_Thresholds(t *testing.T) {
+	below, above := float32(16), float32(30)
+	alerts := NewAlerts([]AlertRule{{Name: "floor", Rooms: []string{"bathroom"}, Below: &below, Above: &above, Hysteresis: 0.5}})
+	start := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	for i, step := range []struct {
+		current  float32
+		expected string
+	}{
+		{17, ""},
+		{15.9, "floor below raised"},
+		// Hysteresis avoids flapping around the threshold
+		{16.2, ""},
+		{15.8, ""},
+		{16.5, "floor below cleared"},
+		{30.5, "floor above raised"},
+		{29.8, ""},
+		{29.5, "floor above cleared"},
+	} {
+		rooms := []warmup4ie.Room{alertRoom(1, "Bathroom", step.current, 20), alertRoom(2, "Kitchen", 10, 20)}
+		events := alerts.Evaluate("home", rooms, start.Add(time.Duration(i)*time.Minute))
+		if states := alertStates(events); states != step.expected {
+			t.Errorf("step %d: bad alerts at %.1f, expected: '%s', actual: '%s'", i, step.current, step.expected, states)
+		}
+	}
+}
+
+func TestAlerts_TargetNotReached(t *testing.T) {
+	alerts := NewAlerts([]AlertRule{{Name: "slow", TargetWithin: time.Hour, Hysteresis: 0.5}})
+	start := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	evaluate := func(elapsed time.Duration, current float32, target float32) []*Event {
+		return alerts.Evaluate("home", []warmup4ie.Room{alertRoom(1, "Room1", current, target)}, start.Add(elapsed))
+	}
+	if events := evaluate(0, 18, 22); len(events) != 0 {
+		t.Errorf("no alert expected before delay, actual: %s", alertStates(events))
+	}
+	if events := evaluate(59*time.Minute, 20, 22); len(events) != 0 {
+		t.Errorf("no alert expected before delay, actual: %s", alertStates(events))
+	}
+	events := evaluate(time.Hour, 21, 22)
+	if alertStates(events) != "slow target_not_reached raised" {
+		t.Fatalf("raised alert expected, actual: %s", alertStates(events))
+	}
+	if alert := events[0].Alert; *alert.Threshold != 22 || alert.Value != 21 || !alert.Since.Equal(start) || events[0].Room.Name != "Room1" {
+		t.Errorf("bad alert: %+v", alert)
+	}
+	// A new target clears the alert and starts the delay again
+	if events := evaluate(70*time.Minute, 21, 24); alertStates(events) != "slow target_not_reached cleared" {
+		t.Errorf("cleared alert expected, actual: %s", alertStates(events))
+	}
+	if events := evaluate(2*time.Hour, 21, 24); len(events) != 0 {
+		t.Errorf("no alert expected before delay, actual: %s", alertStates(events))
+	}
+	if events := evaluate(3*time.Hour, 23.5, 24); alertStates(events) != "" {
+		t.Errorf("target reached within hysteresis, actual: %s", alertStates(events))
+	}
+	// A raised alert is cleared once the target is reached, not at the raising threshold
+	evaluate(3*time.Hour+time.Minute, 23, 24)
+	if events := evaluate(4*time.Hour+time.Minute, 23, 24); alertStates(events) != "slow target_not_reached raised" {
+		t.Errorf("raised alert expected, actual: %s", alertStates(events))
+	}
+	if events := evaluate(4*time.Hour+2*time.Minute, 23.6, 24); len(events) != 0 {
+		t.Errorf("alert must stay raised within hysteresis, actual: %s", alertStates(events))
+	}
+	if events := evaluate(4*time.Hour+3*time.Minute, 24, 24); alertStates(events) != "slow target_not_reached cleared" {
+		t.Errorf("cleared alert expected, actual: %s", alertStates(events))
+	}
+}
+
+func TestAlerts_Stale(t *testing.T) {
+	alerts := NewAlerts([]AlertRule{{Name: "sensor", StaleAfter: 30 * time.Minute}})
+	start := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	evaluate := func(elapsed time.Duration, rooms ...warmup4ie.Room) []*Event {
+		return alerts.Evaluate("home", rooms, start.Add(elapsed))
+	}
+	room1, room2 := alertRoom(1, "Room1", 20, 20), alertRoom(2, "Room2", 20, 20)
+	evaluate(0, room1, room2)
+	// Room 2 is missing from polls, temperature of room 1 is stable
+	if events := evaluate(20*time.Minute, room1); len(events) != 0 {
+		t.Errorf("no alert expected before delay, actual: %s", alertStates(events))
+	}
+	events := evaluate(30*time.Minute, room1)
+	if alertStates(events) != "sensor stale raised" || events[0].Room.Id != 2 || !events[0].Alert.Since.Equal(start) || events[0].Alert.Threshold != nil {
+		t.Errorf("raised alert of room 2 expected, actual: %s", alertStates(events))
+	}
+	if events := evaluate(40*time.Minute, room1, room2); alertStates(events) != "sensor stale cleared" || events[0].Room.Id != 2 {
+		t.Errorf("cleared alert of room 2 expected, actual: %s", alertStates(events))
+	}
+}
+
+func TestAlerts_SetRules(t *testing.T) {
+	below := float32(21)
+	alerts := NewAlerts([]AlertRule{{Name: "cold", Below: &below}})
+	timestamp := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	rooms := []warmup4ie.Room{alertRoom(1, "Room1", 19, 22)}
+	if events := alerts.Evaluate("home", rooms, timestamp); alertStates(events) != "cold below raised" {
+		t.Fatalf("raised alert expected, actual: %s", alertStates(events))
+	}
+	// Raised alerts of kept rules are not raised again
+	alerts.SetRules([]AlertRule{{Name: "cold", Below: &below, Hysteresis: 1}})
+	if events := alerts.Evaluate("home", rooms, timestamp.Add(time.Minute)); len(events) != 0 {
+		t.Errorf("no alert expected, actual: %s", alertStates(events))
+	}
+	alerts.SetRules(nil)
+	if len(alerts.states) != 0 {
+		t.Errorf("states of removed rules must be dropped: %v", alerts.states)
+	}
+}
+
+func TestMonitor_PublishAlerts(t *testing.T) {
+	below := float32(20)
+	publisher := fakePublisher{msg: make(map[string]interface{})}
+	sink := &recordingSink{name: "sink"}
+	m := Monitor{
+		Name:       "home",
+		Thermostat: &thermostatMock{},
+		Publisher:  publisher,
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadTopics,
+		Sinks:      []Sink{sink},
+		Alerts:     NewAlerts([]AlertRule{{Name: "cold", Below: &below}}),
+		now:        func() time.Time { return time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC) },
+	}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload, ok := publisher.msg["room/alerts"].(string)
+	if !ok {
+		t.Fatalf("alert expected on alerts topic, actual: %v", publisher.msg)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		t.Fatalf("unable to decode %s: %v", payload, err)
+	}
+	if event.Event != EventAlert || event.Account != "home" || event.Room.Id != 1 || event.Alert.State != AlertRaised || event.Alert.Value != 19 {
+		t.Errorf("bad alert event: %s", payload)
+	}
+	if len(sink.events) != 1 || sink.events[0].Alert == nil {
+		t.Errorf("alert event must be written to sinks, actual: %+v", sink.events)
+	}
+}
+
+func TestMonitor_PublishAlertsAfterFailure(t *testing.T) {
+	below := float32(20)
+	m := Monitor{
+		Name:       "home",
+		Thermostat: &thermostatMock{},
+		Publisher:  failingPublisher{},
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadTopics,
+		Alerts:     NewAlerts([]AlertRule{{Name: "cold", Below: &below}}),
+		now:        func() time.Time { return time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC) },
+	}
+	_ = m.poll()
+	if len(m.pendingAlerts) != 1 {
+		t.Fatalf("alert not published must be kept, actual: %v", m.pendingAlerts)
+	}
+
+	// The alert stays raised, it is not evaluated again but published on next poll
+	publisher := fakePublisher{msg: make(map[string]interface{})}
+	m.Publisher = publisher
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload, ok := publisher.msg["room/alerts"].(string)
+	if !ok || !strings.Contains(payload, `"state":"raised"`) {
+		t.Errorf("raised alert expected on alerts topic, actual: %v", publisher.msg)
+	}
+	if len(m.pendingAlerts) != 0 {
+		t.Errorf("published alert must not be kept, actual: %v", m.pendingAlerts)
+	}
+}
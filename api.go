@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// Header carrying the api key of write requests
+const APIKeyHeader = "X-API-Key"
+
+// Maximum size of request bodies
+const maxAPIBody = 4096
+
+// APIRoom is the json document of a room returned by the rest api
+type APIRoom struct {
+	*RoomState
+	Account string `json:"account"`
+}
+
+// APILocation is the json document of a location returned by the rest api
+type APILocation struct {
+	Location
+	Account string `json:"account"`
+}
+
+// APIError is the json document returned when a request fails
+type APIError struct {
+	Error *CommandError `json:"error"`
+}
+
+// apiCommand is the body of PUT /rooms/{id}/target and PUT /rooms/{id}/mode
+type apiCommand struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// APIHandler serves the rest api giving rooms of last polls on GET /locations, /rooms and /rooms/{id},
+// and applying commands on PUT /rooms/{id}/target and /rooms/{id}/mode with a body like {"value": 21.5}.
+// Write requests require the api key in X-API-Key header.
+type APIHandler struct {
+	Monitors []*Monitor
+	// Return api key of write requests, writes are refused when it fails or returns an empty key
+	Key func() (string, error)
+}
+
+func NewAPIHandler(monitors []*Monitor, key func() (string, error)) *APIHandler {
+	return &APIHandler{Monitors: monitors, Key: key}
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "locations":
+		h.get(w, r, h.locations)
+	case len(path) == 1 && path[0] == "rooms":
+		h.get(w, r, h.rooms)
+	case len(path) >= 2 && path[0] == "rooms":
+		roomId, err := strconv.Atoi(path[1])
+		if err != nil || len(path) > 3 {
+			writeAPIError(w, http.StatusNotFound, "not_found", "unknown path "+r.URL.Path)
+			return
+		}
+		m, room, ok := h.find(roomId)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("room %d not found", roomId))
+			return
+		}
+		if len(path) == 2 {
+			h.get(w, r, func() interface{} { return room })
+			return
+		}
+		switch path[2] {
+		case CommandTarget:
+			h.put(w, r, func(value json.RawMessage) (interface{}, error) { return setTarget(m, roomId, value) })
+		case CommandMode:
+			h.put(w, r, func(value json.RawMessage) (interface{}, error) { return setMode(m, roomId, value) })
+		default:
+			writeAPIError(w, http.StatusNotFound, "not_found", "unknown path "+r.URL.Path)
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "unknown path "+r.URL.Path)
+	}
+}
+
+func (h *APIHandler) get(w http.ResponseWriter, r *http.Request, document func() interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" not allowed")
+		return
+	}
+	writeAPI(w, http.StatusOK, document())
+}
+
+// put check api key and apply command with value of request body, command result is returned
+func (h *APIHandler) put(w http.ResponseWriter, r *http.Request, command func(value json.RawMessage) (interface{}, error)) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" not allowed")
+		return
+	}
+	if !h.authorized(r) {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid "+APIKeyHeader+" header")
+		return
+	}
+	var body apiCommand
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&body); err != nil || len(body.Value) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_value", `body must be a json document like {"value": ...}`)
+		return
+	}
+	value, err := command(body.Value)
+	if err != nil {
+		commandErr := NewCommandError(err)
+		writeAPI(w, apiStatusCode(commandErr.Code), &APIError{Error: commandErr})
+		return
+	}
+	writeAPI(w, http.StatusOK, map[string]interface{}{"value": value})
+}
+
+func (h *APIHandler) authorized(r *http.Request) bool {
+	if h.Key == nil {
+		return false
+	}
+	key, err := h.Key()
+	if err != nil {
+		log.Printf("api: unable to read api key: %v\n", err)
+		return false
+	}
+	given := r.Header.Get(APIKeyHeader)
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(given)) == 1
+}
+
+func setTarget(m *Monitor, roomId int, value json.RawMessage) (interface{}, error) {
+	var temperature float32
+	if err := json.Unmarshal(value, &temperature); err != nil {
+		return nil, fmt.Errorf("invalid temperature %s: %w", value, warmup4ie.ErrInvalidValue)
+	}
+	if err := m.checkTargetTemperature(roomId, temperature); err != nil {
+		return nil, err
+	}
+	return temperature, m.run(func() error { return m.Thermostat.SetTargetTemperature(roomId, temperature) })
+}
+
+func setMode(m *Monitor, roomId int, value json.RawMessage) (interface{}, error) {
+	var name string
+	if err := json.Unmarshal(value, &name); err != nil {
+		return nil, fmt.Errorf("invalid run mode %s: %w", value, warmup4ie.ErrInvalidValue)
+	}
+	mode, err := warmup4ie.ParseRunMode(name)
+	if err != nil {
+		return nil, err
+	}
+	return mode.String(), m.run(func() error { return m.Thermostat.SetRunMode(roomId, mode) })
+}
+
+// apiStatusCode return http status of command error code
+func apiStatusCode(code string) int {
+	switch code {
+	case "invalid_value":
+		return http.StatusBadRequest
+	case "unsupported_run_mode":
+		return http.StatusUnprocessableEntity
+	case "invalid_credentials", "unauthorized", "rejected":
+		return http.StatusBadGateway
+	case "unavailable", "stopping":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) rooms() interface{} {
+	rooms := []APIRoom{}
+	for _, m := range h.Monitors {
+		polled, timestamp := m.Rooms()
+		for i := range polled {
+			rooms = append(rooms, APIRoom{RoomState: NewRoomState(&polled[i], timestamp), Account: m.Name})
+		}
+	}
+	return rooms
+}
+
+// locations return locations of rooms of last polls
+func (h *APIHandler) locations() interface{} {
+	locations := []APILocation{}
+	seen := make(map[string]bool)
+	for _, m := range h.Monitors {
+		rooms, _ := m.Rooms()
+		for _, room := range rooms {
+			key := m.Name + "/" + strconv.Itoa(room.LocationId)
+			if !seen[key] {
+				seen[key] = true
+				locations = append(locations, APILocation{Location: Location{Id: room.LocationId, Name: room.LocationName}, Account: m.Name})
+			}
+		}
+	}
+	return locations
+}
+
+// find return monitor of account owning room, and room of last poll
+func (h *APIHandler) find(roomId int) (*Monitor, *APIRoom, bool) {
+	for _, m := range h.Monitors {
+		rooms, timestamp := m.Rooms()
+		for i := range rooms {
+			if rooms[i].Id == roomId {
+				return m, &APIRoom{RoomState: NewRoomState(&rooms[i], timestamp), Account: m.Name}, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+func writeAPIError(w http.ResponseWriter, code int, errorCode string, message string) {
+	writeAPI(w, code, &APIError{Error: &CommandError{Code: errorCode, Message: message}})
+}
+
+func writeAPI(w http.ResponseWriter, code int, document interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(document); err != nil {
+		log.Printf("unable to write api response: %v\n", err)
+	}
+}
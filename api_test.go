@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveAPI(t *testing.T, h http.Handler, method string, path string, key string, body string, document interface{}) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(APIKeyHeader, key)
+	}
+	h.ServeHTTP(w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), document); err != nil {
+		t.Fatalf("unable to decode response %s: %v", w.Body.String(), err)
+	}
+	return w.Code
+}
+
+func newAPIHandler(t *testing.T) *APIHandler {
+	m, _ := newCommandMonitor()
+	m.Name = "home"
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return NewAPIHandler([]*Monitor{m}, func() (string, error) { return "secret", nil })
+}
+
+func TestAPIHandler_Rooms(t *testing.T) {
+	h := newAPIHandler(t)
+
+	var rooms []RoomState
+	if code := serveAPI(t, h, http.MethodGet, "/rooms", "", "", &rooms); code != http.StatusOK || len(rooms) != 2 || rooms[1].Name != "Room2" {
+		t.Errorf("rooms of last poll expected, actual: %d %+v", code, rooms)
+	}
+	var room APIRoom
+	code := serveAPI(t, h, http.MethodGet, "/rooms/2", "", "", &room)
+	if code != http.StatusOK || room.RoomState == nil || room.Id != 2 || room.TargetTemperature != 25 || room.Account != "home" {
+		t.Errorf("room 2 expected, actual: %d %+v", code, room)
+	}
+	var locations []APILocation
+	if code := serveAPI(t, h, http.MethodGet, "/locations", "", "", &locations); code != http.StatusOK || len(locations) != 1 {
+		t.Errorf("one location expected, actual: %d %+v", code, locations)
+	}
+	var apiErr APIError
+	if code := serveAPI(t, h, http.MethodGet, "/rooms/3", "", "", &apiErr); code != http.StatusNotFound || apiErr.Error.Code != "not_found" {
+		t.Errorf("unknown room expected, actual: %d %+v", code, apiErr.Error)
+	}
+}
+
+func TestAPIHandler_Commands(t *testing.T) {
+	h := newAPIHandler(t)
+
+	for _, test := range []struct {
+		path  string
+		key   string
+		body  string
+		code  int
+		error string
+	}{
+		{"/rooms/1/target", "", `{"value": 21.5}`, http.StatusUnauthorized, "unauthorized"},
+		{"/rooms/1/target", "wrong", `{"value": 21.5}`, http.StatusUnauthorized, "unauthorized"},
+		{"/rooms/1/target", "secret", `{"value": 21.5}`, http.StatusOK, ""},
+		{"/rooms/1/target", "secret", `{"value": "hot"}`, http.StatusBadRequest, "invalid_value"},
+		{"/rooms/1/target", "secret", `21.5`, http.StatusBadRequest, "invalid_value"},
+		{"/rooms/2/mode", "secret", `{"value": "prog"}`, http.StatusOK, ""},
+		{"/rooms/2/mode", "secret", `{"value": "frost"}`, http.StatusUnprocessableEntity, "unsupported_run_mode"},
+		{"/rooms/2/mode", "secret", `{"value": "sleep"}`, http.StatusBadRequest, "invalid_value"},
+	} {
+		var document struct {
+			Value interface{}   `json:"value"`
+			Error *CommandError `json:"error"`
+		}
+		code := serveAPI(t, h, http.MethodPut, test.path, test.key, test.body, &document)
+		if code != test.code || (test.error == "" && document.Error != nil) || (test.error != "" && (document.Error == nil || document.Error.Code != test.error)) {
+			t.Errorf("PUT %s %s: expected %d %s, actual: %d %+v", test.path, test.body, test.code, test.error, code, document.Error)
+		}
+	}
+
+	var apiErr APIError
+	if code := serveAPI(t, h, http.MethodGet, "/rooms/1/target", "", "", &apiErr); code != http.StatusMethodNotAllowed {
+		t.Errorf("only PUT allowed on commands, actual: %d", code)
+	}
+}
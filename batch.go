@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	DefaultBatchSize = 100
+	// Maximum number of items kept while an output is unreachable, oldest items are dropped
+	DefaultMaxPending = 10000
+)
+
+// batchBuffer holds items waiting to be written by batches by a sink.
+// Oldest items are dropped when too many are pending, a failed batch is kept for next flush.
+type batchBuffer struct {
+	mutex   sync.Mutex
+	pending []interface{}
+	// Number of items dropped from the head of pending
+	dropped int
+	full    chan struct{}
+	// Serialize writes to keep items order
+	writing sync.Mutex
+}
+
+// add append items to pending ones and return the number of oldest items dropped beyond maxPending,
+// a flush is signaled on fullChan when batchSize items are pending. Defaults are used for sizes <= 0.
+func (b *batchBuffer) add(items []interface{}, batchSize int, maxPending int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pending = append(b.pending, items...)
+	dropped := 0
+	if max := sizeOrDefault(maxPending, DefaultMaxPending); len(b.pending) > max {
+		dropped = len(b.pending) - max
+		b.dropped += dropped
+		b.pending = b.pending[dropped:]
+	}
+	if len(b.pending) >= sizeOrDefault(batchSize, DefaultBatchSize) {
+		if b.full == nil {
+			b.full = make(chan struct{}, 1)
+		}
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return dropped
+}
+
+// flush give pending items to write by batches of batchSize, it stops on the first write error
+// and keeps the failed batch and following items for next flush
+func (b *batchBuffer) flush(batchSize int, write func(batch []interface{}) error) error {
+	batchSize = sizeOrDefault(batchSize, DefaultBatchSize)
+	b.writing.Lock()
+	defer b.writing.Unlock()
+	for {
+		b.mutex.Lock()
+		size := len(b.pending)
+		if size > batchSize {
+			size = batchSize
+		}
+		batch := b.pending[:size:size]
+		dropped := b.dropped
+		b.mutex.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := write(batch); err != nil {
+			return err
+		}
+		b.mutex.Lock()
+		// Items of batch may have been dropped while writing
+		if written := len(batch) - (b.dropped - dropped); written > 0 {
+			b.pending = b.pending[written:]
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// fullChan receive a value when a batch is ready to be written
+func (b *batchBuffer) fullChan() chan struct{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.full == nil {
+		b.full = make(chan struct{}, 1)
+	}
+	return b.full
+}
+
+func sizeOrDefault(size int, defaultSize int) int {
+	if size <= 0 {
+		return defaultSize
+	}
+	return size
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBatchBuffer_Flush(t *testing.T) {
+	var b batchBuffer
+	if dropped := b.add([]interface{}{1, 2, 3}, 2, 10); dropped != 0 {
+		t.Errorf("no item must be dropped, actual: %d", dropped)
+	}
+	select {
+	case <-b.fullChan():
+	default:
+		t.Error("full batch must be signaled")
+	}
+
+	var written [][]interface{}
+	err := b.flush(2, func(batch []interface{}) error {
+		written = append(written, batch)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(written, [][]interface{}{{1, 2}, {3}}) || len(b.pending) != 0 {
+		t.Errorf("bad batches: %v, err: %v, pending: %v", written, err, b.pending)
+	}
+}
+
+func TestBatchBuffer_FlushError(t *testing.T) {
+	var b batchBuffer
+	b.add([]interface{}{1, 2, 3}, 2, 10)
+	err := b.flush(2, func(batch []interface{}) error {
+		return errors.New("unreachable")
+	})
+	if err == nil || !reflect.DeepEqual(b.pending, []interface{}{1, 2, 3}) {
+		t.Errorf("failed batch must be kept, err: %v, pending: %v", err, b.pending)
+	}
+}
+
+func TestBatchBuffer_DroppedWhileWriting(t *testing.T) {
+	var b batchBuffer
+	b.add([]interface{}{1, 2, 3}, 10, 3)
+	first := true
+	err := b.flush(2, func(batch []interface{}) error {
+		if first {
+			first = false
+			// 1 and 2 are dropped while the batch is written
+			if dropped := b.add([]interface{}{4, 5}, 10, 3); dropped != 2 {
+				t.Errorf("2 items must be dropped, actual: %d", dropped)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(b.pending) != 0 {
+		t.Errorf("all items must be written, err: %v, pending: %v", err, b.pending)
+	}
+
+	b.add([]interface{}{1, 2, 3}, 10, 3)
+	first = true
+	b.flush(2, func(batch []interface{}) error {
+		if first {
+			first = false
+			// Only 1 of the batch is dropped, 2 is still pending
+			b.add([]interface{}{4}, 10, 3)
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(b.pending, []interface{}{2, 3, 4}) {
+		t.Errorf("failed batch must be kept without dropped items, actual: %v", b.pending)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const DefaultHeartbeat = 1 * time.Hour
+
+// ChangeFilter skips publication of values unchanged since their last publication
+type ChangeFilter struct {
+	// Minimal difference with the last published temperature to publish a new one
+	Deadband float64
+	// Republish all values when the last full refresh is older, 0 to disable
+	Heartbeat time.Duration
+
+	published   map[string]publishedValue
+	lastRefresh time.Time
+	refresh     bool
+}
+
+type publishedValue struct {
+	label  string
+	values []float32
+}
+
+func NewChangeFilter(deadband float64, heartbeat time.Duration) *ChangeFilter {
+	return &ChangeFilter{Deadband: deadband, Heartbeat: heartbeat, published: make(map[string]publishedValue)}
+}
+
+// StartPoll must be called before each poll to decide if all values have to be republished
+func (f *ChangeFilter) StartPoll(now time.Time) {
+	f.refresh = f.lastRefresh.IsZero() || (f.Heartbeat > 0 && now.Sub(f.lastRefresh) >= f.Heartbeat)
+	if f.refresh {
+		f.lastRefresh = now
+	}
+}
+
+// ShouldPublish return true if label changed or one of values moved beyond deadband since last publication on topic.
+// The new value is recorded as published when true is returned.
+func (f *ChangeFilter) ShouldPublish(topic string, label string, values ...float32) bool {
+	previous, ok := f.published[topic]
+	if ok && !f.refresh && !f.changed(previous, label, values) {
+		return false
+	}
+	f.published[topic] = publishedValue{label: label, values: values}
+	return true
+}
+
+// Forget last value published on topic, to publish it again on next poll
+func (f *ChangeFilter) Forget(topic string) {
+	delete(f.published, topic)
+}
+
+func (f *ChangeFilter) changed(previous publishedValue, label string, values []float32) bool {
+	if previous.label != label || len(previous.values) != len(values) {
+		return true
+	}
+	for i, v := range values {
+		diff := math.Abs(float64(v) - float64(previous.values[i]))
+		// Compare with tolerance, temperatures are float32 values
+		if diff > 1e-4 && diff >= f.Deadband-1e-4 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeFilter_Deadband(t *testing.T) {
+	f := NewChangeFilter(0.2, 0)
+	now := time.Date(2019, 11, 2, 10, 0, 0, 0, time.UTC)
+
+	f.StartPoll(now)
+	if !f.ShouldPublish("room/temp", "", 19.0) {
+		t.Errorf("first value must be published")
+	}
+
+	f.StartPoll(now.Add(3 * time.Minute))
+	if f.ShouldPublish("room/temp", "", 19.1) {
+		t.Errorf("change below deadband must not be published")
+	}
+	if !f.ShouldPublish("room/temp", "", 19.2) {
+		t.Errorf("change equals to deadband must be published")
+	}
+	if f.ShouldPublish("room/temp", "", 19.3) {
+		t.Errorf("change must be compared to last published value")
+	}
+	if !f.ShouldPublish("room/state", "fixed", 19.3) {
+		t.Errorf("new topic must be published")
+	}
+	if !f.ShouldPublish("room/state", "prog", 19.3) {
+		t.Errorf("label change must be published")
+	}
+}
+
+func TestChangeFilter_Heartbeat(t *testing.T) {
+	f := NewChangeFilter(0, 1*time.Hour)
+	now := time.Date(2019, 11, 2, 10, 0, 0, 0, time.UTC)
+
+	f.StartPoll(now)
+	f.ShouldPublish("room/temp", "", 19.0)
+
+	f.StartPoll(now.Add(30 * time.Minute))
+	if f.ShouldPublish("room/temp", "", 19.0) {
+		t.Errorf("unchanged value must not be published before heartbeat")
+	}
+
+	f.StartPoll(now.Add(1 * time.Hour))
+	if !f.ShouldPublish("room/temp", "", 19.0) {
+		t.Errorf("unchanged value must be published after heartbeat")
+	}
+
+	f.StartPoll(now.Add(61 * time.Minute))
+	if f.ShouldPublish("room/temp", "", 19.0) {
+		t.Errorf("heartbeat must restart after full refresh")
+	}
+}
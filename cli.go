@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// Subcommands run instead of the bridge, with their usage
+var Subcommands = []struct {
+	Name  string
+	Args  string
+	Usage string
+}{
+	{"locations", "", "List locations of account"},
+	{"rooms", "", "List rooms with their temperatures and run mode"},
+	{"set-target", "<room> <temperature>", "Set target temperature of room, given by id or name"},
+	{"set-mode", "<room> <mode>", "Set run mode of room, given by id or name"},
+	{"holiday", "<start> <end> <temperature> | cancel", "Plan or cancel holiday of location, start and end as YYYY-MM-DD[THH:MM] local time"},
+}
+
+// IsSubcommand return true if name is a subcommand
+func IsSubcommand(name string) bool {
+	for _, command := range Subcommands {
+		if command.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepted formats of holiday start and end
+var holidayTimeFormats = []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// WarmupClient is the warmup client used by subcommands
+type WarmupClient interface {
+	warmup4ie.Thermostat
+	SetHoliday(locationId int, start time.Time, end time.Time, temperature float32) error
+	CancelHoliday(locationId int) error
+}
+
+// CLI runs subcommands with a warmup client and prints their result as a table or as json
+type CLI struct {
+	Client WarmupClient
+	Out    io.Writer
+	JSON   bool
+	// Location of holiday command given by id or name, the only location of account when empty
+	Location string
+	now      func() time.Time
+}
+
+// cliLocation is the json document printed by locations command
+type cliLocation struct {
+	Id      int         `json:"id"`
+	Name    string      `json:"name"`
+	Mode    string      `json:"mode"`
+	Holiday *cliHoliday `json:"holiday,omitempty"`
+}
+
+type cliHoliday struct {
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	Temperature float32 `json:"temperature"`
+}
+
+// holidayResult is the json document printed by holiday command
+type holidayResult struct {
+	Success    bool        `json:"success"`
+	LocationId int         `json:"location_id"`
+	Holiday    *cliHoliday `json:"holiday,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// RunSubcommand run subcommand with configuration flags and env, return the exit code
+func RunSubcommand(name string, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	c := CLI{Out: stdout}
+	fs.BoolVar(&c.JSON, "json", false, "Print json instead of a table")
+	fs.StringVar(&c.Location, "location", "", "Location of holiday command, given by id or name, the only location of account when empty")
+	accountName := fs.String("account", "", "Name of warmup account of accounts section, first account when empty")
+	config, _, err := loadConfig(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	accounts := config.AccountList()
+	account := accounts[0]
+	if *accountName != "" {
+		found := false
+		for _, a := range accounts {
+			if a.Name == *accountName {
+				account, found = a, true
+			}
+		}
+		if !found {
+			fmt.Fprintf(stderr, "unknown account %s\n", *accountName)
+			return 2
+		}
+	}
+	c.Client = account.NewClient(nil)
+	if err := c.Run(name, fs.Args()); err != nil {
+		if c.JSON {
+			writeJSON(stdout, &APIError{Error: NewCommandError(err)})
+		} else {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// Run execute subcommand with its positional arguments
+func (c *CLI) Run(name string, args []string) error {
+	expected := map[string]int{"locations": 0, "rooms": 0, "set-target": 2, "set-mode": 2}
+	if count, ok := expected[name]; ok && len(args) != count {
+		return fmt.Errorf("%s expects %d arguments, actual %d: %w", name, count, len(args), warmup4ie.ErrInvalidValue)
+	}
+	switch name {
+	case "locations":
+		return c.locations()
+	case "rooms":
+		return c.rooms()
+	case "set-target":
+		return c.setTarget(args[0], args[1])
+	case "set-mode":
+		return c.setMode(args[0], args[1])
+	case "holiday":
+		return c.holiday(args)
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+}
+
+func (c *CLI) locations() error {
+	locations, err := c.Client.ListLocations()
+	if err != nil {
+		return err
+	}
+	var result []cliLocation
+	for _, location := range *locations {
+		l := cliLocation{Id: location.Id, Name: location.Name, Mode: location.LocMode}
+		if h := location.Holiday; h != nil && h.HolStart != "" && h.HolStart != "-" {
+			l.Holiday = &cliHoliday{Start: h.HolStart, End: h.HolEnd, Temperature: (&warmup4ie.Temperature{RawTemperature: h.HolTemp}).GetValue()}
+		}
+		result = append(result, l)
+	}
+	if c.JSON {
+		return writeJSON(c.Out, result)
+	}
+	return c.table([]string{"ID", "NAME", "MODE", "HOLIDAY"}, len(result), func(i int) []string {
+		l := result[i]
+		holiday := ""
+		if l.Holiday != nil {
+			holiday = fmt.Sprintf("%s to %s at %.1f°C", l.Holiday.Start, l.Holiday.End, l.Holiday.Temperature)
+		}
+		return []string{strconv.Itoa(l.Id), l.Name, l.Mode, holiday}
+	})
+}
+
+func (c *CLI) rooms() error {
+	rooms, err := c.Client.ListRooms()
+	if err != nil {
+		return err
+	}
+	var states []*RoomState
+	for i := range *rooms {
+		states = append(states, NewRoomState(&(*rooms)[i], c.timestamp()))
+	}
+	if c.JSON {
+		return writeJSON(c.Out, states)
+	}
+	return c.table([]string{"ID", "NAME", "LOCATION", "MODE", "CURRENT", "TARGET"}, len(states), func(i int) []string {
+		s := states[i]
+		return []string{strconv.Itoa(s.Id), s.Name, s.Location.Name, s.RunMode,
+			fmt.Sprintf("%.1f°C", s.CurrentTemperature), fmt.Sprintf("%.1f°C", s.TargetTemperature)}
+	})
+}
+
+func (c *CLI) setTarget(key string, value string) error {
+	room, err := c.findRoom(key)
+	if err != nil {
+		return err
+	}
+	temperature, err := warmup4ie.ParseTemperature(value)
+	if err != nil {
+		return err
+	}
+	if err := checkTargetRange(room, temperature); err != nil {
+		return err
+	}
+	if err := c.Client.SetTargetTemperature(room.Id, temperature); err != nil {
+		return err
+	}
+	return c.result(&CommandResult{Command: CommandTarget, RoomId: room.Id, Value: temperature},
+		fmt.Sprintf("%s target temperature set to %.1f°C", room.Name, temperature))
+}
+
+func (c *CLI) setMode(key string, value string) error {
+	room, err := c.findRoom(key)
+	if err != nil {
+		return err
+	}
+	mode, err := warmup4ie.ParseRunMode(value)
+	if err != nil {
+		return err
+	}
+	if err := c.Client.SetRunMode(room.Id, mode); err != nil {
+		return err
+	}
+	return c.result(&CommandResult{Command: CommandMode, RoomId: room.Id, Value: mode.String()},
+		fmt.Sprintf("%s run mode set to %s", room.Name, mode))
+}
+
+func (c *CLI) holiday(args []string) error {
+	if len(args) != 1 && len(args) != 3 || len(args) == 1 && args[0] != "cancel" {
+		return fmt.Errorf("holiday expects <start> <end> <temperature> or cancel: %w", warmup4ie.ErrInvalidValue)
+	}
+	location, err := c.findLocation()
+	if err != nil {
+		return err
+	}
+	result := holidayResult{Success: true, LocationId: location.Id, Timestamp: c.timestamp().UTC()}
+	if len(args) == 1 {
+		if err := c.Client.CancelHoliday(location.Id); err != nil {
+			return err
+		}
+		if c.JSON {
+			return writeJSON(c.Out, &result)
+		}
+		_, err := fmt.Fprintf(c.Out, "holiday of %s cancelled\n", location.Name)
+		return err
+	}
+	start, err := parseHolidayTime(args[0])
+	if err != nil {
+		return err
+	}
+	end, err := parseHolidayTime(args[1])
+	if err != nil {
+		return err
+	}
+	temperature, err := warmup4ie.ParseTemperature(args[2])
+	if err != nil {
+		return err
+	}
+	if err := c.Client.SetHoliday(location.Id, start, end, temperature); err != nil {
+		return err
+	}
+	result.Holiday = &cliHoliday{Start: start.Format(warmup4ie.HolidayTimeFormat), End: end.Format(warmup4ie.HolidayTimeFormat), Temperature: temperature}
+	if c.JSON {
+		return writeJSON(c.Out, &result)
+	}
+	_, err = fmt.Fprintf(c.Out, "holiday of %s planned from %s to %s at %.1f°C\n", location.Name, result.Holiday.Start, result.Holiday.End, temperature)
+	return err
+}
+
+func parseHolidayTime(value string) (time.Time, error) {
+	for _, format := range holidayTimeFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', expected YYYY-MM-DD or YYYY-MM-DDTHH:MM: %w", value, warmup4ie.ErrInvalidValue)
+}
+
+// findRoom return room of current location given by id, name or slug of name
+func (c *CLI) findRoom(key string) (*warmup4ie.Room, error) {
+	rooms, err := c.Client.ListRooms()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range *rooms {
+		room := &(*rooms)[i]
+		if strconv.Itoa(room.Id) == key || strings.EqualFold(room.Name, key) || Slug(room.Name) == key {
+			return room, nil
+		}
+		names = append(names, room.Name)
+	}
+	return nil, fmt.Errorf("unknown room '%s', expected one of %s: %w", key, strings.Join(names, ", "), warmup4ie.ErrInvalidValue)
+}
+
+// findLocation return location given by Location, or the only location of account
+func (c *CLI) findLocation() (*warmup4ie.Location, error) {
+	locations, err := c.Client.ListLocations()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range *locations {
+		location := &(*locations)[i]
+		if c.Location == "" && len(*locations) == 1 ||
+			c.Location != "" && (strconv.Itoa(location.Id) == c.Location || strings.EqualFold(location.Name, c.Location)) {
+			return location, nil
+		}
+		names = append(names, location.Name)
+	}
+	if c.Location == "" {
+		return nil, fmt.Errorf("several locations, select one with -location: %s: %w", strings.Join(names, ", "), warmup4ie.ErrInvalidValue)
+	}
+	return nil, fmt.Errorf("unknown location '%s', expected one of %s: %w", c.Location, strings.Join(names, ", "), warmup4ie.ErrInvalidValue)
+}
+
+// result print result of a room command
+func (c *CLI) result(result *CommandResult, message string) error {
+	if c.JSON {
+		result.Success = true
+		result.Timestamp = c.timestamp().UTC()
+		return writeJSON(c.Out, result)
+	}
+	_, err := fmt.Fprintln(c.Out, message)
+	return err
+}
+
+// table print rows aligned in columns
+func (c *CLI) table(header []string, count int, row func(i int) []string) error {
+	w := tabwriter.NewWriter(c.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for i := 0; i < count; i++ {
+		fmt.Fprintln(w, strings.Join(row(i), "\t"))
+	}
+	return w.Flush()
+}
+
+func (c *CLI) timestamp() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func writeJSON(w io.Writer, document interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
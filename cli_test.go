@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+type cliClientMock struct {
+	thermostatMock
+	locations string
+	calls     []string
+}
+
+func (c *cliClientMock) ListLocations() (*[]warmup4ie.Location, error) {
+	var locations []warmup4ie.Location
+	err := json.Unmarshal([]byte(c.locations), &locations)
+	return &locations, err
+}
+
+func (c *cliClientMock) SetTargetTemperature(roomId int, temperature float32) error {
+	c.calls = append(c.calls, "target")
+	return nil
+}
+
+func (c *cliClientMock) SetHoliday(locationId int, start time.Time, end time.Time, temperature float32) error {
+	c.calls = append(c.calls, "holiday "+start.Format(warmup4ie.HolidayTimeFormat)+" "+end.Format(warmup4ie.HolidayTimeFormat))
+	return nil
+}
+
+func (c *cliClientMock) CancelHoliday(locationId int) error {
+	c.calls = append(c.calls, "cancel")
+	return nil
+}
+
+func newCLI(json bool) (*CLI, *cliClientMock, *bytes.Buffer) {
+	client := &cliClientMock{locations: `[{"Id": 10, "Name": "Home", "LocMode": "holiday",
+		"Holiday": {"HolStart": "2019-12-20 08:00", "HolEnd": "2019-12-27 18:00", "HolTemp": 120}}]`}
+	var out bytes.Buffer
+	now := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	return &CLI{Client: client, Out: &out, JSON: json, now: func() time.Time { return now }}, client, &out
+}
+
+func TestCLI_Locations(t *testing.T) {
+	c, _, out := newCLI(false)
+	if err := c.Run("locations", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ID  NAME  MODE     HOLIDAY\n" +
+		"10  Home  holiday  2019-12-20 08:00 to 2019-12-27 18:00 at 12.0°C\n"
+	if out.String() != expected {
+		t.Errorf("bad table, expected:\n%s\nactual:\n%s", expected, out.String())
+	}
+}
+
+func TestCLI_RoomsJSON(t *testing.T) {
+	c, _, out := newCLI(true)
+	if err := c.Run("rooms", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var rooms []RoomState
+	if err := json.Unmarshal(out.Bytes(), &rooms); err != nil {
+		t.Fatalf("unable to decode %s: %v", out.String(), err)
+	}
+	if len(rooms) != 2 || rooms[1].Name != "Room2" || rooms[1].TargetTemperature != 25 || rooms[1].RunMode != "forced" {
+		t.Errorf("bad rooms: %+v", rooms)
+	}
+}
+
+func TestCLI_SetTarget(t *testing.T) {
+	c, client, out := newCLI(true)
+	if err := c.Run("set-target", []string{"room2", "21.5"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var result CommandResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("unable to decode %s: %v", out.String(), err)
+	}
+	if !result.Success || result.RoomId != 2 || result.Value != 21.5 || len(client.calls) != 1 {
+		t.Errorf("bad result: %+v, calls: %v", result, client.calls)
+	}
+
+	for _, args := range [][]string{{"room3", "21"}, {"1", "hot"}, {"1", "NaN"}, {"1", "Inf"}, {"1"}} {
+		if err := c.Run("set-target", args); !errors.Is(err, warmup4ie.ErrInvalidValue) {
+			t.Errorf("invalid value expected for %v, actual: %v", args, err)
+		}
+	}
+}
+
+func TestCLI_SetMode(t *testing.T) {
+	c, _, out := newCLI(false)
+	if err := c.Run("set-mode", []string{"Room1", "prog"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "Room1 run mode set to prog\n" {
+		t.Errorf("bad output: %s", out.String())
+	}
+	if err := c.Run("set-mode", []string{"1", "frost"}); !errors.Is(err, warmup4ie.ErrUnsupportedRunMode) {
+		t.Errorf("unsupported run mode expected, actual: %v", err)
+	}
+}
+
+func TestCLI_Holiday(t *testing.T) {
+	c, client, _ := newCLI(false)
+	if err := c.Run("holiday", []string{"2019-12-20", "2019-12-27T18:00", "12"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Run("holiday", []string{"cancel"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(client.calls, ",") != "holiday 2019-12-20 00:00 2019-12-27 18:00,cancel" {
+		t.Errorf("bad calls: %v", client.calls)
+	}
+
+	client.locations = `[{"Id": 10, "Name": "Home"}, {"Id": 11, "Name": "Office"}]`
+	if err := c.Run("holiday", []string{"cancel"}); !errors.Is(err, warmup4ie.ErrInvalidValue) {
+		t.Errorf("location must be selected when account has several locations, actual: %v", err)
+	}
+	c.Location = "office"
+	if err := c.Run("holiday", []string{"cancel"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.Run("holiday", []string{"20/12/2019", "2019-12-27", "12"}); !errors.Is(err, warmup4ie.ErrInvalidValue) {
+		t.Errorf("invalid value expected, actual: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const (
+	CommandTarget = "target"
+	CommandMode   = "mode"
+)
+
+// ErrStopping is returned for commands received during shutdown
+var ErrStopping = errors.New("shutting down")
+
+// CommandResult is published on response topic after each command
+type CommandResult struct {
+	Success bool   `json:"success"`
+	Command string `json:"command"`
+	RoomId  int    `json:"room_id"`
+	// Value applied to the room
+	Value     interface{}   `json:"value,omitempty"`
+	Error     *CommandError `json:"error,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+type CommandError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewCommandError build error reported to command sender from warmup error
+func NewCommandError(err error) *CommandError {
+	code := "internal_error"
+	switch {
+	case errors.Is(err, warmup4ie.ErrInvalidValue):
+		code = "invalid_value"
+	case errors.Is(err, warmup4ie.ErrUnsupportedRunMode):
+		code = "unsupported_run_mode"
+	case errors.Is(err, warmup4ie.ErrInvalidCredentials):
+		code = "invalid_credentials"
+	case errors.Is(err, warmup4ie.ErrUnauthorized):
+		code = "unauthorized"
+	case errors.Is(err, warmup4ie.ErrRejected):
+		code = "rejected"
+	case errors.Is(err, warmup4ie.ErrUnavailable):
+		code = "unavailable"
+	case errors.Is(err, ErrStopping):
+		code = "stopping"
+	}
+	return &CommandError{Code: code, Message: err.Error()}
+}
+
+// subscribeCommands subscribe to command topics of rooms not already subscribed
+func (m *Monitor) subscribeCommands(rooms []warmup4ie.Room) error {
+	subscriber, ok := m.Publisher.(mqttdevice.Subscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions, commands are not available")
+	}
+	if m.Payload == PayloadDomoticz {
+		return m.subscribeDomoticz(subscriber, rooms)
+	}
+	for i := range rooms {
+		roomId := rooms[i].Id
+		topic, modeTopic, err := m.commandTopics(&rooms[i])
+		if errors.Is(err, ErrInvalidTopic) {
+			log.Printf("%scommands of room skipped: %v\n", m.logPrefix(), err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Commands are applied outside of mqtt client goroutine to not block reception
+		if err := m.subscribeCommand(subscriber, topic, func(msg *mqttdevice.Message) {
+			m.apply(func() { m.handleTargetCommand(roomId, msg) })
+		}); err != nil {
+			return err
+		}
+		if err := m.subscribeCommand(subscriber, modeTopic, func(msg *mqttdevice.Message) {
+			m.apply(func() { m.handleModeCommand(roomId, msg) })
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandTopics return target temperature and run mode command topics of room, homie set topics in homie mode
+func (m *Monitor) commandTopics(room *warmup4ie.Room) (string, string, error) {
+	topics := m.topics()
+	if m.payload() == PayloadHomie {
+		return topics.HomieTopic(room, HomieTargetTemperature, "set"), topics.HomieTopic(room, HomieRunMode, "set"), nil
+	}
+	target, err := topics.TargetCommandTopic(room)
+	if err != nil {
+		return "", "", err
+	}
+	mode, err := topics.ModeCommandTopic(room)
+	if err != nil {
+		return "", "", err
+	}
+	return target, mode, nil
+}
+
+// apply run command in its own goroutine, commands received during shutdown are ignored
+func (m *Monitor) apply(command func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stopping {
+		log.Printf("shutting down, command ignored\n")
+		return
+	}
+	m.inflight.Add(1)
+	go func() {
+		defer m.inflight.Done()
+		command()
+	}()
+}
+
+// run apply command in the calling goroutine, it is refused during shutdown
+func (m *Monitor) run(command func() error) error {
+	m.mutex.Lock()
+	if m.stopping {
+		m.mutex.Unlock()
+		return ErrStopping
+	}
+	m.inflight.Add(1)
+	m.mutex.Unlock()
+	defer m.inflight.Done()
+	if err := command(); err != nil {
+		return err
+	}
+	m.recordCommand()
+	return nil
+}
+
+func (m *Monitor) subscribeCommand(subscriber mqttdevice.Subscriber, topic string, handler mqttdevice.MessageHandler) error {
+	m.mutex.Lock()
+	subscribed := m.subscriptions[topic]
+	m.mutex.Unlock()
+	if subscribed {
+		return nil
+	}
+	if err := subscriber.Subscribe(topic, handler); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = make(map[string]bool)
+	}
+	m.subscriptions[topic] = true
+	return nil
+}
+
+func (m *Monitor) handleTargetCommand(roomId int, msg *mqttdevice.Message) {
+	result := CommandResult{Command: CommandTarget, RoomId: roomId}
+	temperature, err := m.parseTargetTemperature(roomId, string(msg.Payload))
+	if err == nil {
+		err = m.Thermostat.SetTargetTemperature(roomId, temperature)
+		result.Value = temperature
+	}
+	if err == nil {
+		m.recordCommand()
+	}
+	m.reply(msg, &result, err)
+}
+
+func (m *Monitor) parseTargetTemperature(roomId int, payload string) (float32, error) {
+	temperature, err := warmup4ie.ParseTemperature(payload)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.checkTargetTemperature(roomId, temperature); err != nil {
+		return 0, err
+	}
+	return temperature, nil
+}
+
+// checkTargetTemperature check temperature is in the range of room thermostat when room is known
+func (m *Monitor) checkTargetTemperature(roomId int, temperature float32) error {
+	if room, ok := m.room(roomId); ok {
+		return checkTargetRange(&room, temperature)
+	}
+	return nil
+}
+
+// checkTargetRange check temperature is in the range of room thermostat
+func checkTargetRange(room *warmup4ie.Room, temperature float32) error {
+	if len(room.Thermostat4IES) > 0 {
+		minTemp := room.Thermostat4IES[0].MinTemp.GetValue()
+		maxTemp := room.Thermostat4IES[0].MaxTemp.GetValue()
+		if temperature < minTemp || temperature > maxTemp {
+			return fmt.Errorf("temperature %.1f out of range [%.1f, %.1f]: %w", temperature, minTemp, maxTemp, warmup4ie.ErrInvalidValue)
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) handleModeCommand(roomId int, msg *mqttdevice.Message) {
+	result := CommandResult{Command: CommandMode, RoomId: roomId}
+	mode, err := warmup4ie.ParseRunMode(string(msg.Payload))
+	if err == nil {
+		err = m.Thermostat.SetRunMode(roomId, mode)
+		result.Value = mode.String()
+	}
+	if err == nil {
+		m.recordCommand()
+	}
+	m.reply(msg, &result, err)
+}
+
+// recordCommand notify the poll loop that a command was applied, to confirm the new state sooner
+func (m *Monitor) recordCommand() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastCommand = m.timestamp()
+	if m.commandApplied == nil {
+		m.commandApplied = make(chan struct{}, 1)
+	}
+	select {
+	case m.commandApplied <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Monitor) applied() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.commandApplied == nil {
+		m.commandApplied = make(chan struct{}, 1)
+	}
+	return m.commandApplied
+}
+
+// reply publish command result on response topic of message or on '<command topic>/result',
+// correlation data of the command is sent back with mqtt 5.
+// In homie mode, applied value is published on property topic and result only on response topic.
+func (m *Monitor) reply(msg *mqttdevice.Message, result *CommandResult, err error) {
+	result.Success = err == nil
+	result.Timestamp = m.timestamp().UTC()
+	if err != nil {
+		log.Printf("command %s on room %d failed: %v\n", result.Command, result.RoomId, err)
+		result.Value = nil
+		result.Error = NewCommandError(err)
+	}
+	if m.payload() == PayloadHomie {
+		if err == nil {
+			m.publishHomieValue(strings.TrimSuffix(msg.Topic, "/set"), result.Value)
+		}
+		if msg.ResponseTopic == "" {
+			return
+		}
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("unable to marshal command result: %v\n", err)
+		return
+	}
+	topic := msg.ResponseTopic
+	if topic == "" {
+		topic = msg.Topic + "/result"
+	}
+	err = m.publish(topic, string(payload), &mqttdevice.Properties{
+		ContentType:     "application/json",
+		CorrelationData: msg.CorrelationData,
+	})
+	if err != nil {
+		log.Printf("unable to publish command result: %v\n", err)
+	}
+}
+
+func (m *Monitor) room(roomId int) (warmup4ie.Room, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	room, ok := m.rooms[roomId]
+	return room, ok
+}
+
+// Rooms return rooms of last poll sorted by id, and time of the poll
+func (m *Monitor) Rooms() ([]warmup4ie.Room, time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rooms := make([]warmup4ie.Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+	return rooms, m.roomsTime
+}
+
+// updateRooms record rooms of last poll and return rooms of previous poll, nil before first poll
+func (m *Monitor) updateRooms(rooms []warmup4ie.Room) map[int]warmup4ie.Room {
+	timestamp := m.timestamp()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous := m.rooms
+	m.roomsTime = timestamp
+	m.rooms = make(map[int]warmup4ie.Room, len(rooms))
+	for _, room := range rooms {
+		m.rooms[room.Id] = room
+	}
+	return previous
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+type fakeSubscriber struct {
+	fakePublisher
+	handlers map[string]mqttdevice.MessageHandler
+}
+
+func (f fakeSubscriber) Subscribe(topic string, handler mqttdevice.MessageHandler) error {
+	f.handlers[topic] = handler
+	return nil
+}
+
+func newCommandMonitor() (*Monitor, fakeSubscriber) {
+	p := fakeSubscriber{fakePublisher{msg: make(map[string]interface{})}, make(map[string]mqttdevice.MessageHandler)}
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  p,
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadTopics,
+		Commands:   true,
+		now:        func() time.Time { return time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC) },
+	}
+	return &m, p
+}
+
+func decodeResult(t *testing.T, payload interface{}) *CommandResult {
+	var result CommandResult
+	if payload == nil {
+		t.Fatalf("no result published")
+	}
+	if err := json.Unmarshal([]byte(payload.(string)), &result); err != nil {
+		t.Fatalf("unable to decode result %v: %v", payload, err)
+	}
+	return &result
+}
+
+func TestMonitor_SubscribeCommands(t *testing.T) {
+	m, p := newCommandMonitor()
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, topic := range []string{
+		"room/room1/temperature/floor/target/set",
+		"room/room1/mode/set",
+		"room/room2/temperature/floor/target/set",
+		"room/room2/mode/set",
+	} {
+		if p.handlers[topic] == nil {
+			t.Errorf("no subscription on command topic %s", topic)
+		}
+	}
+}
+
+func TestMonitor_HandleTargetCommand(t *testing.T) {
+	m, p := newCommandMonitor()
+
+	m.handleTargetCommand(1, &mqttdevice.Message{Topic: "room/room1/temperature/floor/target/set", Payload: []byte("21.5")})
+	result := decodeResult(t, p.msg["room/room1/temperature/floor/target/set/result"])
+	if !result.Success || result.Value != 21.5 || result.RoomId != 1 || result.Command != CommandTarget {
+		t.Errorf("bad result: %+v", result)
+	}
+
+	m.handleTargetCommand(1, &mqttdevice.Message{Topic: "room/room1/temperature/floor/target/set", Payload: []byte("hot"), ResponseTopic: "client/response"})
+	result = decodeResult(t, p.msg["client/response"])
+	if result.Success || result.Error == nil || result.Error.Code != "invalid_value" {
+		t.Errorf("invalid value error expected: %+v", result)
+	}
+
+	// NaN passes range comparisons, it must be rejected by the parser
+	m.handleTargetCommand(1, &mqttdevice.Message{Topic: "room/room1/temperature/floor/target/set", Payload: []byte("NaN"), ResponseTopic: "client/response"})
+	result = decodeResult(t, p.msg["client/response"])
+	if result.Success || result.Error == nil || result.Error.Code != "invalid_value" {
+		t.Errorf("invalid value error expected for NaN: %+v", result)
+	}
+}
+
+func TestMonitor_HandleModeCommand(t *testing.T) {
+	m, p := newCommandMonitor()
+
+	m.handleModeCommand(2, &mqttdevice.Message{Topic: "room/room2/mode/set", Payload: []byte("prog")})
+	result := decodeResult(t, p.msg["room/room2/mode/set/result"])
+	if !result.Success || result.Value != "prog" {
+		t.Errorf("bad result: %+v", result)
+	}
+
+	m.handleModeCommand(2, &mqttdevice.Message{Topic: "room/room2/mode/set", Payload: []byte("frost")})
+	result = decodeResult(t, p.msg["room/room2/mode/set/result"])
+	if result.Success || result.Error == nil || result.Error.Code != "unsupported_run_mode" {
+		t.Errorf("unsupported run mode error expected: %+v", result)
+	}
+}
+
+func TestMonitor_TargetOutOfRange(t *testing.T) {
+	m, p := newCommandMonitor()
+	room := warmup4ie.Room{Id: 1, Name: "Room1"}
+	room.Thermostat4IES = append(room.Thermostat4IES, struct {
+		MinTemp warmup4ie.Temperature
+		MaxTemp warmup4ie.Temperature
+	}{warmup4ie.Temperature{RawTemperature: 50}, warmup4ie.Temperature{RawTemperature: 300}})
+	m.updateRooms([]warmup4ie.Room{room})
+
+	m.handleTargetCommand(1, &mqttdevice.Message{Topic: "cmd", Payload: []byte("31")})
+	result := decodeResult(t, p.msg["cmd/result"])
+	if result.Success || result.Error.Code != "invalid_value" {
+		t.Errorf("invalid value error expected: %+v", result)
+	}
+}
+
+func TestMonitor_RunCancel(t *testing.T) {
+	m, p := newCommandMonitor()
+	m.IdleTime = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("monitor must stop when context is cancelled")
+	}
+
+	p.handlers["room/room1/mode/set"](&mqttdevice.Message{Topic: "room/room1/mode/set", Payload: []byte("prog")})
+	m.inflight.Wait()
+	if _, ok := p.msg["room/room1/mode/set/result"]; ok {
+		t.Errorf("commands received after shutdown must be ignored")
+	}
+}
+
+func TestMonitor_CommandDuringReload(t *testing.T) {
+	m, _ := newCommandMonitor()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			m.Reconfigure(&Settings{Topics: DefaultTopicLayout("other"), Payload: PayloadJson, Schedule: &PollSchedule{}, MessageExpiry: time.Minute})
+			m.applySettings()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		m.handleModeCommand(1, &mqttdevice.Message{Topic: "room/room1/mode/set", Payload: []byte("prog")})
+		if _, _, err := m.commandTopics(&warmup4ie.Room{Id: 1, Name: "Room1"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	<-done
+}
+
+// unavailableSubscriber fails subscriptions until it is available
+type unavailableSubscriber struct {
+	fakeSubscriber
+	available bool
+}
+
+func (u *unavailableSubscriber) Subscribe(topic string, handler mqttdevice.MessageHandler) error {
+	if !u.available {
+		return fmt.Errorf("not connected")
+	}
+	return u.fakeSubscriber.Subscribe(topic, handler)
+}
+
+func TestMonitor_SubscribeFailure(t *testing.T) {
+	m, p := newCommandMonitor()
+	subscriber := &unavailableSubscriber{fakeSubscriber: p}
+	m.Publisher = subscriber
+	if err := m.poll(); err != nil {
+		t.Fatalf("subscribe errors must not fail the poll: %v", err)
+	}
+	if p.msg["room/room1/temperature/floor"] != "19.0" {
+		t.Errorf("rooms must be published, actual: %v", p.msg)
+	}
+	subscriber.available = true
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.handlers["room/room1/temperature/floor/target/set"] == nil {
+		t.Errorf("subscription must be retried on next poll, actual: %v", p.handlers)
+	}
+}
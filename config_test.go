@@ -0,0 +1,469 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+)
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	file, clean := writeConfig(t, `
+broker:
+  uri: tcp://broker:1883
+  version: 5
+warmup:
+  email: user@example.com
+  password: secret
+topics:
+  base: home
+  room_key: id
+  state: "{{.Base}}/rooms/{{.Room}}"
+publish:
+  payload: json
+polling:
+  interval: 5m
+  profiles:
+    - 22:00-06:00=15m
+rooms:
+  1234: bathroom
+`)
+	defer clean()
+	os.Setenv("MQTT_QOS", "1")
+	defer os.Unsetenv("MQTT_QOS")
+
+	config, configFile, err := LoadConfig([]string{"-config", file, "-mqtt-topic-base", "warmup"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if configFile != file {
+		t.Errorf("bad configuration file: %v", configFile)
+	}
+	if config.Broker.Uri != "tcp://broker:1883" || config.Broker.Version != 5 || config.Broker.Qos != 1 {
+		t.Errorf("bad broker config: %+v", config.Broker)
+	}
+	if config.Topics.Base != "warmup" {
+		t.Errorf("flag must override configuration file, actual: %v", config.Topics.Base)
+	}
+	if config.Polling.Interval != 5*time.Minute || config.Polling.RetryDelay != DefaultRetryDelay {
+		t.Errorf("bad polling config: %+v", config.Polling)
+	}
+
+	settings, err := config.Settings(config.AccountList()[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if settings.Payload != PayloadJson || len(settings.Schedule.Profiles) != 1 || settings.Changes != nil {
+		t.Errorf("bad settings: %+v", settings)
+	}
+	if settings.Topics.RoomKey != RoomKeyId || settings.Topics.RoomNames[1234] != "bathroom" {
+		t.Errorf("bad topic layout: %+v", settings.Topics)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	file, clean := writeConfig(t, `
+broker:
+  qos: 3
+  version: 4
+polling:
+  interval: 0s
+`)
+	defer clean()
+
+	_, _, err := LoadConfig([]string{"-config=" + file})
+	if err == nil {
+		t.Fatalf("error expected")
+	}
+	for _, expected := range []string{"broker.qos", "broker.version", "warmup.email", "polling.interval"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfig_UnknownField(t *testing.T) {
+	file, clean := writeConfig(t, "broker:\n  url: tcp://broker:1883\n")
+	defer clean()
+
+	if _, _, err := LoadConfig([]string{"-config", file}); err == nil || !strings.Contains(err.Error(), "url") {
+		t.Errorf("error on unknown field expected: %v", err)
+	}
+}
+
+func TestLoadConfig_Accounts(t *testing.T) {
+	file, clean := writeConfig(t, `
+accounts:
+  - name: home
+    email: home@example.com
+    password: secret
+  - name: office
+    email: office@example.com
+    password: secret
+    topic_base: work/warmup
+    poll_interval: 10m
+`)
+	defer clean()
+
+	config, _, err := LoadConfig([]string{"-config", file})
+	if err != nil {
+		t.Fatalf("warmup section is not required with accounts: %v", err)
+	}
+	accounts := config.AccountList()
+	if len(accounts) != 2 {
+		t.Fatalf("2 accounts expected, actual: %+v", accounts)
+	}
+	home, err := config.Settings(accounts[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if home.Topics.Base != "home" || home.Schedule.Interval != DefaultPollInterval {
+		t.Errorf("account name and global interval expected, actual: %v %v", home.Topics.Base, home.Schedule.Interval)
+	}
+	office, err := config.Settings(accounts[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if office.Topics.Base != "work/warmup" || office.Schedule.Interval != 10*time.Minute || office.Backoff.Max != 10*time.Minute {
+		t.Errorf("account topic base and interval expected, actual: %v %v", office.Topics.Base, office.Schedule.Interval)
+	}
+
+	config.Accounts[1].TopicBase = "home"
+	config.Accounts[1].Name = "home"
+	config.Accounts[1].Email = ""
+	err = config.Validate()
+	if err == nil {
+		t.Fatalf("error expected")
+	}
+	for _, expected := range []string{"accounts[1].name", "accounts[1].email", "accounts[1].topic_base"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+}
+
+func TestConfig_AccountList(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Topics.Base = "warmup"
+	accounts := config.AccountList()
+	if len(accounts) != 1 || accounts[0].Name != DefaultAccountName || accounts[0].Email != "user@example.com" || accounts[0].topicBase() != "warmup" {
+		t.Errorf("account of warmup section expected, actual: %+v", accounts)
+	}
+	// Topics of single account stay at the root when topic base is not set
+	config.Topics.Base = ""
+	if accounts := config.AccountList(); accounts[0].topicBase() != "" {
+		t.Errorf("empty topic base expected, actual: %s", accounts[0].topicBase())
+	}
+}
+
+func TestConfig_NewPublisher_Brokers(t *testing.T) {
+	file, clean := writeConfig(t, `
+broker:
+  uri: tcp://mosquitto:1883
+  version: 5
+brokers:
+  - name: building
+    uri: tcp://remote:1883
+    qos: 1
+    retain: true
+    topic_prefix: building/42
+warmup:
+  email: user@example.com
+  password: secret
+`)
+	defer clean()
+
+	config, _, err := LoadConfig([]string{"-config", file})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	publisher, err := config.NewPublisher(&mqttdevice.Availability{Topic: "warmup/availability"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	multi, ok := publisher.(*mqttdevice.MultiPublisher)
+	if !ok || len(multi.Brokers) != 2 {
+		t.Fatalf("publisher of 2 brokers expected, actual: %+v", publisher)
+	}
+	remote, ok := multi.Brokers[1].Publisher.(*mqttdevice.Paho5MqttPublisher)
+	if !ok || remote.ClientId != DefaultClientId || remote.Qos != 1 || !remote.Retain {
+		t.Errorf("broker settings with main broker version and client id expected, actual: %+v", multi.Brokers[1].Publisher)
+	}
+	if multi.Brokers[1].Name != "building" || multi.Brokers[1].TopicPrefix != "building/42" || remote.Availability.Topic != "building/42/warmup/availability" {
+		t.Errorf("prefixed topics expected, actual: %+v %+v", multi.Brokers[1], remote.Availability)
+	}
+
+	config.Brokers[0].TLS.CAFile = "missing.pem"
+	config.Brokers[0].Qos = 3
+	err = config.Validate()
+	for _, expected := range []string{"brokers[0].tls", "brokers[0].qos"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+}
+
+func TestConfig_InfluxWithoutBroker(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Broker.Disabled = true
+	config.Publish.Commands = true
+	err := config.Validate()
+	for _, expected := range []string{"broker.disabled", "publish.commands"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+
+	config.Publish.Commands = false
+	config.InfluxDB.Url = "http://influxdb:8086"
+	config.InfluxDB.Org = "home"
+	config.InfluxDB.Bucket = "warmup"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if publisher, _ := config.NewPublisher(nil); publisher != (mqttdevice.NopPublisher{}) {
+		t.Errorf("no broker expected, actual: %+v", publisher)
+	}
+	if sink := config.NewInfluxSink(); sink == nil || sink.Bucket != "warmup" || sink.BatchSize != DefaultBatchSize {
+		t.Errorf("bad influxdb sink: %+v", sink)
+	}
+}
+
+func TestConfig_SQL(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Broker.Disabled = true
+	config.SQL.DSN = "mysql://db/warmup"
+	config.SQL.Table = "room-history"
+	err := config.Validate()
+	for _, expected := range []string{"sql.dsn", "sql.table"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+
+	config.SQL.DSN = "postgres://db/warmup"
+	config.SQL.Table = DefaultSQLTable
+	if err := config.Validate(); err != nil {
+		t.Errorf("sql is an output when broker is disabled: %v", err)
+	}
+	previous := DefaultConfig()
+	if changed := config.RestartRequired(previous); !strings.Contains(strings.Join(changed, ","), "sql") {
+		t.Errorf("sql change requires restart: %v", changed)
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	previous := DefaultConfig()
+	config := DefaultConfig()
+	config.Polling.Interval = time.Minute
+	if changed := config.RestartRequired(previous); len(changed) != 0 {
+		t.Errorf("polling changes don't require restart: %v", changed)
+	}
+	config.Broker.Uri = "tcp://other:1883"
+	if changed := config.RestartRequired(previous); len(changed) != 1 || changed[0] != "broker" {
+		t.Errorf("broker change requires restart: %v", changed)
+	}
+	config.Broker = previous.Broker
+	config.Accounts = []AccountConfig{{Name: "home", Email: "user@example.com", Password: "secret"}}
+	if changed := config.RestartRequired(previous); len(changed) != 1 || changed[0] != "accounts" {
+		t.Errorf("new account requires restart: %v", changed)
+	}
+}
+
+func TestConfig_KeepRestartSettings(t *testing.T) {
+	current := DefaultConfig()
+	current.Topics.Base = "warmup"
+	current.Accounts = []AccountConfig{{Name: "home", Email: "user@example.com", Password: "secret", TopicBase: "home"}}
+	config := DefaultConfig()
+	config.Polling.Interval = time.Minute
+	config.Topics.Base = "heating"
+	config.Topics.Templates.Availability = "{{.Base}}/status"
+	config.Accounts = []AccountConfig{{Name: "home", Email: "user@example.com", Password: "secret", TopicBase: "house"},
+		{Name: "office", Email: "office@example.com", Password: "secret"}}
+
+	changed := config.KeepRestartSettings(current)
+	if strings.Join(changed, ",") != "accounts,availability topic" {
+		t.Errorf("bad changed settings: %v", changed)
+	}
+	if config.Topics.Base != "warmup" || config.Topics.Templates.Availability != current.Topics.Templates.Availability {
+		t.Errorf("topics in use must be kept: %+v", config.Topics)
+	}
+	if !reflect.DeepEqual(config.Accounts, current.Accounts) {
+		t.Errorf("accounts in use must be kept: %+v", config.Accounts)
+	}
+	if config.Polling.Interval != time.Minute {
+		t.Errorf("polling must be reloaded: %v", config.Polling.Interval)
+	}
+
+	config.Accounts = []AccountConfig{{Name: "home", Email: "user@example.com", Password: "secret", TopicBase: "house"}}
+	if changed := config.KeepRestartSettings(current); len(changed) != 0 {
+		t.Errorf("topic base of account doesn't require restart: %v", changed)
+	}
+	if config.Accounts[0].TopicBase != "house" {
+		t.Errorf("topic base of account must be reloaded: %+v", config.Accounts)
+	}
+}
+
+func TestMonitor_Reconfigure(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m := Monitor{Thermostat: &thermostatMock{}, Publisher: p, Topics: DefaultTopicLayout("room"), Payload: PayloadTopics}
+
+	topics, _ := NewTopicLayout("home", TopicTemplates{})
+	m.Reconfigure(&Settings{Topics: topics, Payload: PayloadTopics, Schedule: &PollSchedule{Interval: time.Minute}})
+	m.applySettings()
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.msg["home/room1/temperature/floor"] != "19.0" {
+		t.Errorf("new topic layout must be used after reconfiguration: %v", p.msg)
+	}
+	if m.pollInterval(time.Now()) != time.Minute {
+		t.Errorf("new poll interval expected: %v", m.pollInterval(time.Now()))
+	}
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	if _, _, err := LoadConfig([]string{"-config", "config.example.yaml"}); err != nil {
+		t.Errorf("example configuration must be valid: %v", err)
+	}
+}
+
+func TestConfig_API(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.API.Listen = ":8081"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "api.key") {
+		t.Errorf("error on api.key expected: %v", err)
+	}
+	keyFile, clean := writeConfig(t, "secret\n")
+	defer clean()
+	config.API.KeyFile = keyFile
+	if err := config.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if key, err := config.API.KeyProvider()(); err != nil || key != "secret" {
+		t.Errorf("key of file expected, actual: %s %v", key, err)
+	}
+}
+
+func TestConfig_HomieRequiresRetain(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Publish.Payload = string(PayloadHomie)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "broker.retain") {
+		t.Errorf("error on broker.retain expected: %v", err)
+	}
+	config.Broker.Retain = true
+	if err := config.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfig_Webhooks(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Webhooks = []WebhookConfig{{Url: "ftp://example.com", Events: []string{"sunrise"}, Body: "{{.Missing"}}
+	err := config.Validate()
+	for _, expected := range []string{"webhooks[0].url", "webhooks[0].events", "webhooks[0].body"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+
+	config.Webhooks = []WebhookConfig{{Url: "https://example.com/hook", Events: []string{EventRunMode}, Body: `{"room": {{json .Room.Name}}}`}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hooks, err := config.NewWebhooks()
+	if err != nil || len(hooks) != 1 || hooks[0].Name != "https://example.com/hook" || hooks[0].MaxRetries != DefaultWebhookMaxRetries || hooks[0].Body == nil {
+		t.Errorf("bad webhooks: %+v %v", hooks, err)
+	}
+	if changed := config.RestartRequired(DefaultConfig()); !strings.Contains(strings.Join(changed, ","), "webhooks") {
+		t.Errorf("webhooks change requires restart: %v", changed)
+	}
+}
+
+func TestConfig_Domoticz(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	config.Publish.Payload = string(PayloadDomoticz)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "domoticz.rooms") {
+		t.Errorf("error on domoticz.rooms expected: %v", err)
+	}
+	config.Domoticz.Rooms = []DomoticzRoomConfig{{RoomId: 1, TemperatureIdx: 10, SetpointIdx: 11}, {RoomId: 1, SetpointIdx: 10}, {RoomId: 2}}
+	err := config.Validate()
+	for _, expected := range []string{"domoticz.rooms[1].room_id", "domoticz.rooms[1].setpoint_idx", "domoticz.rooms[2]: temperature_idx or setpoint_idx"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+
+	config.Domoticz.Rooms = config.Domoticz.Rooms[:1]
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := config.NewDomoticz()
+	if d == nil || d.InTopic != DefaultDomoticzInTopic || d.OutTopic != DefaultDomoticzOutTopic || d.Rooms[1] != (DomoticzDevice{TemperatureIdx: 10, SetpointIdx: 11}) {
+		t.Errorf("bad domoticz: %+v", d)
+	}
+	previous := *config
+	previous.Publish.Payload = string(PayloadJson)
+	if changed := config.RestartRequired(&previous); len(changed) != 1 || changed[0] != "domoticz" {
+		t.Errorf("switching to domoticz payload must require a restart, actual: %v", changed)
+	}
+}
+
+func TestConfig_Alerts(t *testing.T) {
+	config := DefaultConfig()
+	config.Warmup = WarmupConfig{Email: "user@example.com", Password: "secret"}
+	below, above, hysteresis := float32(16), float32(12), float32(-1)
+	config.Alerts = []AlertConfig{
+		{Name: "floor", Rooms: []string{""}, Below: &below, Above: &above, Hysteresis: &hysteresis},
+		{Name: "floor", TargetWithin: -time.Hour},
+		{Name: "empty"},
+	}
+	err := config.Validate()
+	for _, expected := range []string{"alerts[0].rooms[0]", "alerts[0].above", "alerts[0].hysteresis", "alerts[1].name", "alerts[1].target_within", "alerts[2]: below"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("error on %s expected: %v", expected, err)
+		}
+	}
+
+	above = 30
+	config.Alerts = []AlertConfig{{Name: "floor", Rooms: []string{"bathroom"}, Below: &below, Above: &above}, {Name: "slow", TargetWithin: time.Hour}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	settings, err := config.Settings(config.AccountList()[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rules := settings.Alerts.Rules
+	if len(rules) != 2 || *rules[0].Below != 16 || rules[0].Hysteresis != DefaultAlertHysteresis || rules[1].TargetWithin != time.Hour {
+		t.Errorf("bad alert rules: %+v", rules)
+	}
+	previous := *config
+	previous.Alerts = nil
+	if changed := config.RestartRequired(&previous); len(changed) != 0 {
+		t.Errorf("alerts must be applied on reload, actual: %v", changed)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPasswordCommandTimeout is the maximum duration of password command, it runs while the account is locked for login
+const DefaultPasswordCommandTimeout = 10 * time.Second
+
+// passwordCommandTimeout is changed by tests
+var passwordCommandTimeout = DefaultPasswordCommandTimeout
+
+// CredentialSources are the sources of credentials read again on each login, at most one can be set.
+// They replace the password of the configuration, and the user for a credentials file.
+type CredentialSources struct {
+	// File containing the password, like docker and kubernetes secrets
+	PasswordFile string `yaml:"password_file"`
+	// Command printing the password on its standard output, arguments are separated by spaces
+	PasswordCommand string `yaml:"password_command"`
+	// YAML file with email or username, and password keys
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// credentialsFile is the content of a credentials file, email is used for warmup and username for brokers
+type credentialsFile struct {
+	Email    string `yaml:"email"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// IsSet return true if a source is set
+func (s *CredentialSources) IsSet() bool {
+	return *s != (CredentialSources{})
+}
+
+// HasUser return true if sources give the user
+func (s *CredentialSources) HasUser() bool {
+	return s.CredentialsFile != ""
+}
+
+func (s *CredentialSources) validate() error {
+	count := 0
+	for _, source := range []string{s.PasswordFile, s.PasswordCommand, s.CredentialsFile} {
+		if source != "" {
+			count++
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("only one of password_file, password_command and credentials_file can be set")
+	}
+	if s.PasswordCommand != "" && len(strings.Fields(s.PasswordCommand)) == 0 {
+		return fmt.Errorf("empty password_command")
+	}
+	return nil
+}
+
+// Credentials read user and password from sources, user and password are returned when they aren't given by sources
+func (s *CredentialSources) Credentials(user string, password string) (string, string, error) {
+	switch {
+	case s.PasswordFile != "":
+		content, err := ioutil.ReadFile(s.PasswordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read password file: %w", err)
+		}
+		return user, strings.TrimRight(string(content), "\r\n"), nil
+	case s.PasswordCommand != "":
+		args := strings.Fields(s.PasswordCommand)
+		ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if ctx.Err() != nil {
+			return "", "", fmt.Errorf("password command %s failed: %w", args[0], ctx.Err())
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("password command %s failed: %w", args[0], err)
+		}
+		return user, strings.TrimRight(string(output), "\r\n"), nil
+	case s.CredentialsFile != "":
+		content, err := ioutil.ReadFile(s.CredentialsFile)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read credentials file: %w", err)
+		}
+		var credentials credentialsFile
+		if err := yaml.UnmarshalStrict(content, &credentials); err != nil {
+			return "", "", fmt.Errorf("invalid credentials file %s: %w", s.CredentialsFile, err)
+		}
+		if credentials.Email != "" {
+			user = credentials.Email
+		} else if credentials.Username != "" {
+			user = credentials.Username
+		}
+		return user, credentials.Password, nil
+	default:
+		return user, password, nil
+	}
+}
+
+// Provider return function reading credentials from sources on each call
+func (s CredentialSources) Provider(user string, password string) func() (string, string, error) {
+	return func() (string, string, error) {
+		return s.Credentials(user, password)
+	}
+}
+
+// secretProvider return function returning secret, or content of file read on each call when file is set
+func secretProvider(secret string, file string) func() (string, error) {
+	return func() (string, error) {
+		if file == "" {
+			return secret, nil
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCredentialSources(t *testing.T) {
+	passwordFile, clean := writeConfig(t, "secret\n")
+	defer clean()
+	credentialsFile, cleanCredentials := writeConfig(t, "email: other@example.com\npassword: other\n")
+	defer cleanCredentials()
+
+	for _, test := range []struct {
+		sources  CredentialSources
+		user     string
+		password string
+	}{
+		{CredentialSources{}, "user@example.com", "configured"},
+		{CredentialSources{PasswordFile: passwordFile}, "user@example.com", "secret"},
+		{CredentialSources{PasswordCommand: "echo  command secret"}, "user@example.com", "command secret"},
+		{CredentialSources{CredentialsFile: credentialsFile}, "other@example.com", "other"},
+	} {
+		user, password, err := test.sources.Provider("user@example.com", "configured")()
+		if err != nil {
+			t.Errorf("unexpected error with %+v: %v", test.sources, err)
+		}
+		if user != test.user || password != test.password {
+			t.Errorf("bad credentials with %+v, expected: %s %s, actual: %s %s", test.sources, test.user, test.password, user, password)
+		}
+	}
+
+	if _, _, err := (&CredentialSources{PasswordFile: "missing"}).Credentials("user", ""); err == nil {
+		t.Errorf("error expected when password file is missing")
+	}
+	if err := (&CredentialSources{PasswordFile: passwordFile, CredentialsFile: credentialsFile}).validate(); err == nil {
+		t.Errorf("error expected when several sources are set")
+	}
+}
+
+func TestCredentialSources_PasswordCommandTimeout(t *testing.T) {
+	passwordCommandTimeout = 10 * time.Millisecond
+	defer func() { passwordCommandTimeout = DefaultPasswordCommandTimeout }()
+	start := time.Now()
+	_, _, err := (&CredentialSources{PasswordCommand: "sleep 5"}).Credentials("user", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("deadline exceeded error expected, actual: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("hung password command must be killed, duration: %v", time.Since(start))
+	}
+}
+
+func TestLoadConfig_PasswordFile(t *testing.T) {
+	passwordFile, clean := writeConfig(t, "secret\n")
+	defer clean()
+	os.Setenv("WARMUP_PASSWORD_FILE", passwordFile)
+	defer os.Unsetenv("WARMUP_PASSWORD_FILE")
+
+	config, _, err := LoadConfig([]string{"-warmup-email", "user@example.com"})
+	if err != nil {
+		t.Fatalf("password is not required with a password file: %v", err)
+	}
+	account := config.AccountList()[0]
+	if _, password, err := account.Credentials(account.Email, account.Password); err != nil || password != "secret" {
+		t.Errorf("password of file expected, actual: %s %v", password, err)
+	}
+}
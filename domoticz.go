@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const (
+	DefaultDomoticzInTopic  = "domoticz/in"
+	DefaultDomoticzOutTopic = "domoticz/out"
+)
+
+// DomoticzDevice are the domoticz devices of a room, 0 when the room has no such device
+type DomoticzDevice struct {
+	// Temperature sensor receiving current temperature
+	TemperatureIdx int
+	// Thermostat setpoint receiving target temperature, its changes in domoticz are applied to the room
+	SetpointIdx int
+}
+
+// Domoticz publishes rooms to domoticz devices and dispatches setpoint changes of domoticz to monitors of rooms
+type Domoticz struct {
+	InTopic  string
+	OutTopic string
+	// Devices by room id, rooms without device are not published
+	Rooms map[int]DomoticzDevice
+
+	mutex sync.Mutex
+	// Setpoint handlers by idx
+	setpoints map[int]func(value string)
+	// Serializes subscription of out topic by monitors
+	subscription sync.Mutex
+	subscribed   bool
+}
+
+// domoticzIn is the message published on domoticz in topic to update a device
+type domoticzIn struct {
+	Command string `json:"command"`
+	Idx     int    `json:"idx"`
+	Nvalue  int    `json:"nvalue"`
+	Svalue  string `json:"svalue"`
+}
+
+// domoticzOut is the part of messages published by domoticz on out topic used to apply setpoint changes
+type domoticzOut struct {
+	Idx     int    `json:"idx"`
+	Svalue1 string `json:"svalue1"`
+}
+
+// handle register handler of setpoint changes of device idx
+func (d *Domoticz) handle(idx int, handler func(value string)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.setpoints == nil {
+		d.setpoints = make(map[int]func(value string))
+	}
+	d.setpoints[idx] = handler
+}
+
+// subscribe to out topic once for all monitors, messages are dispatched to the monitor of the device
+func (d *Domoticz) subscribe(subscriber mqttdevice.Subscriber) error {
+	d.subscription.Lock()
+	defer d.subscription.Unlock()
+	if d.subscribed {
+		return nil
+	}
+	if err := subscriber.Subscribe(d.OutTopic, d.dispatch); err != nil {
+		return fmt.Errorf("unable to subscribe to domoticz out topic: %w", err)
+	}
+	d.subscribed = true
+	return nil
+}
+
+// dispatch call handler of device of out message, messages of other devices are ignored
+func (d *Domoticz) dispatch(msg *mqttdevice.Message) {
+	var out domoticzOut
+	if err := json.Unmarshal(msg.Payload, &out); err != nil {
+		log.Printf("domoticz: invalid message on %s: %v\n", msg.Topic, err)
+		return
+	}
+	d.mutex.Lock()
+	handler := d.setpoints[out.Idx]
+	d.mutex.Unlock()
+	if handler != nil && out.Svalue1 != "" {
+		handler(out.Svalue1)
+	}
+}
+
+// publishDomoticz publish temperature and setpoint of rooms mapped to domoticz devices
+func (m *Monitor) publishDomoticz(rooms []warmup4ie.Room) error {
+	if m.Domoticz == nil {
+		return fmt.Errorf("domoticz devices of rooms are not configured")
+	}
+	for i := range rooms {
+		room := &rooms[i]
+		device := m.Domoticz.Rooms[room.Id]
+		if device.TemperatureIdx > 0 {
+			if err := m.publishDomoticzValue(device.TemperatureIdx, room.CurrentTemp.GetValue(), true); err != nil {
+				return err
+			}
+		}
+		if device.SetpointIdx > 0 {
+			if err := m.publishDomoticzValue(device.SetpointIdx, room.TargetTemp.GetValue(), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishDomoticzValue publish temperature of device idx, filtered by change filter when filter is set
+func (m *Monitor) publishDomoticzValue(idx int, temperature float32, filter bool) error {
+	key := fmt.Sprintf("%s/%d", m.Domoticz.InTopic, idx)
+	if filter && m.Changes != nil && !m.Changes.ShouldPublish(key, "", temperature) {
+		return nil
+	}
+	payload, err := json.Marshal(&domoticzIn{Command: "udevice", Idx: idx, Svalue: fmt.Sprintf("%.1f", temperature)})
+	if err != nil {
+		return err
+	}
+	err = m.publish(m.Domoticz.InTopic, string(payload), nil)
+	if err != nil && filter && m.Changes != nil {
+		m.Changes.Forget(key)
+	}
+	return err
+}
+
+// subscribeDomoticz register setpoint handlers of rooms and subscribe to domoticz out topic
+func (m *Monitor) subscribeDomoticz(subscriber mqttdevice.Subscriber, rooms []warmup4ie.Room) error {
+	if m.Domoticz == nil {
+		return fmt.Errorf("domoticz devices of rooms are not configured")
+	}
+	for _, room := range rooms {
+		roomId := room.Id
+		if idx := m.Domoticz.Rooms[roomId].SetpointIdx; idx > 0 {
+			m.Domoticz.handle(idx, func(value string) {
+				m.apply(func() { m.handleDomoticzSetpoint(roomId, value) })
+			})
+		}
+	}
+	// Out topic is shared by accounts, devices of other accounts are handled by their monitor
+	return m.Domoticz.subscribe(subscriber)
+}
+
+// handleDomoticzSetpoint apply setpoint changed in domoticz to room, setpoint of last poll is restored in domoticz on failure.
+// Setpoints equal to target temperature of last poll are ignored, they are the echo of published values.
+func (m *Monitor) handleDomoticzSetpoint(roomId int, value string) {
+	room, known := m.room(roomId)
+	temperature, err := m.parseTargetTemperature(roomId, value)
+	if err == nil && known && temperature == room.TargetTemp.GetValue() {
+		return
+	}
+	if err == nil {
+		err = m.Thermostat.SetTargetTemperature(roomId, temperature)
+	}
+	if err == nil {
+		m.recordCommand()
+		return
+	}
+	log.Printf("%sdomoticz setpoint %s of room %d not applied: %v\n", m.logPrefix(), value, roomId, err)
+	if known {
+		if err := m.publishDomoticzValue(m.Domoticz.Rooms[roomId].SetpointIdx, room.TargetTemp.GetValue(), false); err != nil {
+			log.Printf("%sunable to restore domoticz setpoint: %v\n", m.logPrefix(), err)
+		}
+	}
+}
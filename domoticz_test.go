@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// domoticzBroker records messages published on domoticz in topic
+type domoticzBroker struct {
+	fakeSubscriber
+	mutex      sync.Mutex
+	messages   []string
+	subscribes int
+}
+
+func (b *domoticzBroker) Subscribe(topic string, handler mqttdevice.MessageHandler) error {
+	b.mutex.Lock()
+	b.subscribes++
+	b.mutex.Unlock()
+	return b.fakeSubscriber.Subscribe(topic, handler)
+}
+
+func (b *domoticzBroker) Publish(topic string, payload interface{}) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.messages = append(b.messages, topic+" "+payload.(string))
+	return nil
+}
+
+func (b *domoticzBroker) published() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+type targetThermostat struct {
+	thermostatMock
+	mutex   sync.Mutex
+	targets map[int]float32
+}
+
+func (t *targetThermostat) SetTargetTemperature(roomId int, temperature float32) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if roomId == 2 {
+		return warmup4ie.ErrRejected
+	}
+	t.targets[roomId] = temperature
+	return nil
+}
+
+// emptyThermostat is an account without rooms
+type emptyThermostat struct {
+	thermostatMock
+}
+
+func (t *emptyThermostat) ListRooms() (*[]warmup4ie.Room, error) {
+	return &[]warmup4ie.Room{}, nil
+}
+
+func newDomoticzMonitor() (*Monitor, *domoticzBroker, *targetThermostat) {
+	broker := &domoticzBroker{fakeSubscriber: fakeSubscriber{fakePublisher{msg: make(map[string]interface{})}, make(map[string]mqttdevice.MessageHandler)}}
+	thermostat := &targetThermostat{targets: make(map[int]float32)}
+	m := Monitor{
+		Thermostat: thermostat,
+		Publisher:  broker,
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadDomoticz,
+		Commands:   true,
+		Domoticz: &Domoticz{InTopic: DefaultDomoticzInTopic, OutTopic: DefaultDomoticzOutTopic, Rooms: map[int]DomoticzDevice{
+			1: {TemperatureIdx: 10, SetpointIdx: 11},
+			2: {SetpointIdx: 21},
+		}},
+		now: func() time.Time { return time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC) },
+	}
+	return &m, broker, thermostat
+}
+
+func TestMonitor_PublishDomoticz(t *testing.T) {
+	m, broker, _ := newDomoticzMonitor()
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		`domoticz/in {"command":"udevice","idx":10,"nvalue":0,"svalue":"19.0"}`,
+		`domoticz/in {"command":"udevice","idx":11,"nvalue":0,"svalue":"22.0"}`,
+		`domoticz/in {"command":"udevice","idx":21,"nvalue":0,"svalue":"25.0"}`,
+	}
+	messages := broker.published()
+	if len(messages) != len(expected) {
+		t.Fatalf("%d messages expected, actual: %v", len(expected), messages)
+	}
+	for i, message := range expected {
+		if messages[i] != message {
+			t.Errorf("bad message %d, expected: %s, actual: %s", i, message, messages[i])
+		}
+	}
+	if broker.handlers[DefaultDomoticzOutTopic] == nil {
+		t.Errorf("domoticz out topic must be subscribed: %v", broker.handlers)
+	}
+}
+
+func TestMonitor_DomoticzSetpoint(t *testing.T) {
+	m, broker, thermostat := newDomoticzMonitor()
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	broker.published()
+	out := func(payload string) {
+		broker.handlers[DefaultDomoticzOutTopic](&mqttdevice.Message{Topic: DefaultDomoticzOutTopic, Payload: []byte(payload)})
+		m.inflight.Wait()
+	}
+
+	// Echo of published setpoint and other devices are ignored
+	out(`{"idx": 11, "dtype": "Thermostat", "stype": "SetPoint", "nvalue": 0, "svalue1": "22.00"}`)
+	out(`{"idx": 99, "nvalue": 1, "svalue1": "0"}`)
+	out(`not json`)
+	if len(thermostat.targets) != 0 {
+		t.Errorf("no setpoint expected, actual: %v", thermostat.targets)
+	}
+
+	out(`{"idx": 11, "dtype": "Thermostat", "stype": "SetPoint", "nvalue": 0, "svalue1": "20.50"}`)
+	if thermostat.targets[1] != 20.5 {
+		t.Errorf("setpoint of room 1 expected, actual: %v", thermostat.targets)
+	}
+
+	// Setpoint of last poll is restored when rejected
+	out(`{"idx": 21, "nvalue": 0, "svalue1": "18.00"}`)
+	if messages := broker.published(); len(messages) != 1 || messages[0] != `domoticz/in {"command":"udevice","idx":21,"nvalue":0,"svalue":"25.0"}` {
+		t.Errorf("restored setpoint of room 2 expected, actual: %v", messages)
+	}
+}
+
+func TestMonitor_DomoticzSharedSubscription(t *testing.T) {
+	m, broker, thermostat := newDomoticzMonitor()
+	// Second account sharing broker and domoticz devices, it owns no mapped room
+	other := &Monitor{Name: "office", Thermostat: &emptyThermostat{}, Publisher: broker, Topics: DefaultTopicLayout("office"),
+		Payload: PayloadDomoticz, Commands: true, Domoticz: m.Domoticz, now: m.now}
+	for _, monitor := range []*Monitor{m, other, m} {
+		if err := monitor.poll(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if broker.subscribes != 1 {
+		t.Errorf("domoticz out topic must be subscribed once, actual: %d", broker.subscribes)
+	}
+	broker.handlers[DefaultDomoticzOutTopic](&mqttdevice.Message{Topic: DefaultDomoticzOutTopic, Payload: []byte(`{"idx": 11, "svalue1": "20.50"}`)})
+	m.inflight.Wait()
+	if thermostat.targets[1] != 20.5 {
+		t.Errorf("setpoint must be applied by the monitor of the room, actual: %v", thermostat.targets)
+	}
+}
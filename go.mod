@@ -4,9 +4,13 @@ go 1.13
 
 require (
 	github.com/Microsoft/hcsshim v0.8.6 // indirect
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/testcontainers/testcontainers-go v0.0.8
-	golang.org/x/net v0.0.0-20191021144547-ec77196f6094 // indirect
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
 	google.golang.org/genproto v0.0.0-20190522204451-c2c4e71fbf69 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const DefaultReadyPollIntervals = 3
+
+// Check is the result of one readiness check
+type Check struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Health is the json document returned by health endpoints
+type Health struct {
+	Status   string           `json:"status"`
+	Checks   map[string]Check `json:"checks,omitempty"`
+	Accounts []AccountHealth  `json:"accounts"`
+	// Poll status of first account
+	LastPoll            *time.Time `json:"last_poll,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Timestamp           time.Time  `json:"timestamp"`
+}
+
+// AccountHealth is the poll status of a warmup account
+type AccountHealth struct {
+	Name                string     `json:"name"`
+	LastPoll            *time.Time `json:"last_poll,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// HealthHandler serves /healthz (process alive) and /readyz (bridge working) endpoints
+type HealthHandler struct {
+	// Monitors of warmup accounts, they share the same publisher
+	Monitors []*Monitor
+	// Bridge is not ready if last successful poll is older than this number of poll intervals
+	PollIntervals int
+	mux           *http.ServeMux
+}
+
+func NewHealthHandler(monitors []*Monitor, pollIntervals int) *HealthHandler {
+	h := HealthHandler{Monitors: monitors, PollIntervals: pollIntervals, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/readyz", h.readyz)
+	return &h
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *HealthHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	health.Checks = nil
+	health.Status = StatusOk
+	writeHealth(w, http.StatusOK, health)
+}
+
+func (h *HealthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	code := http.StatusOK
+	if health.Status != StatusOk {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, health)
+}
+
+// health run readiness checks, checks of accounts are suffixed by account name when there are several accounts
+func (h *HealthHandler) health() *Health {
+	health := Health{Status: StatusOk, Checks: make(map[string]Check), Accounts: []AccountHealth{}}
+	for i, m := range h.Monitors {
+		status := m.Status()
+		now := m.timestamp()
+		suffix := ""
+		if len(h.Monitors) > 1 {
+			suffix = "." + m.Name
+		}
+		account := AccountHealth{
+			Name:                m.Name,
+			LastSuccess:         status.LastSuccess,
+			LastError:           status.LastError,
+			ConsecutiveFailures: status.ConsecutiveFailures,
+		}
+		if !status.Timestamp.IsZero() {
+			account.LastPoll = &status.Timestamp
+		}
+		health.Accounts = append(health.Accounts, account)
+		if i == 0 {
+			health.Checks["broker"] = checkBroker(m)
+			health.LastPoll, health.LastSuccess = account.LastPoll, account.LastSuccess
+			health.LastError, health.ConsecutiveFailures = account.LastError, account.ConsecutiveFailures
+			health.Timestamp = now.UTC()
+		}
+		health.Checks["warmup_login"+suffix] = checkLogin(m)
+		health.Checks["last_poll"+suffix] = h.checkLastPoll(m, status.LastSuccess, now)
+	}
+	for _, check := range health.Checks {
+		if !check.Ok {
+			health.Status = StatusError
+		}
+	}
+	return &health
+}
+
+func checkBroker(m *Monitor) Check {
+	checker, ok := m.Publisher.(mqttdevice.ConnectionChecker)
+	if ok && !checker.IsConnected() {
+		return Check{Ok: false, Message: "not connected to broker"}
+	}
+	return Check{Ok: true}
+}
+
+func checkLogin(m *Monitor) Check {
+	checker, ok := m.Thermostat.(warmup4ie.LoginChecker)
+	if ok && !checker.LoginValid() {
+		return Check{Ok: false, Message: "warmup login failed"}
+	}
+	return Check{Ok: true}
+}
+
+func (h *HealthHandler) checkLastPoll(m *Monitor, lastSuccess *time.Time, now time.Time) Check {
+	if lastSuccess == nil {
+		return Check{Ok: false, Message: "no successful poll yet"}
+	}
+	maxAge := time.Duration(h.PollIntervals) * m.pollInterval(now)
+	if age := now.Sub(*lastSuccess); h.PollIntervals > 0 && age > maxAge {
+		return Check{Ok: false, Message: fmt.Sprintf("last successful poll %v ago, older than %v", age.Round(time.Second), maxAge)}
+	}
+	return Check{Ok: true}
+}
+
+func writeHealth(w http.ResponseWriter, code int, health *Health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		log.Printf("unable to write health response: %v\n", err)
+	}
+}
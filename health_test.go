@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type disconnectedPublisher struct {
+	fakePublisher
+}
+
+func (f disconnectedPublisher) IsConnected() bool {
+	return false
+}
+
+func getHealth(t *testing.T, h http.Handler, path string) (int, *Health) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var health Health
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("unable to decode response %s: %v", w.Body.String(), err)
+	}
+	return w.Code, &health
+}
+
+func TestHealthHandler_Ready(t *testing.T) {
+	now := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  fakePublisher{msg: make(map[string]interface{})},
+		Topics:     DefaultTopicLayout("room"),
+		IdleTime:   3 * time.Minute,
+		now:        func() time.Time { return now },
+	}
+	h := NewHealthHandler([]*Monitor{&m}, 3)
+
+	if code, health := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable || health.Checks["last_poll"].Ok {
+		t.Errorf("not ready expected before first poll, actual: %d %+v", code, health)
+	}
+	if code, health := getHealth(t, h, "/healthz"); code != http.StatusOK || health.Status != StatusOk {
+		t.Errorf("alive expected, actual: %d %+v", code, health)
+	}
+
+	m.recordSuccess(now)
+	code, health := getHealth(t, h, "/readyz")
+	if code != http.StatusOK || health.Status != StatusOk || health.LastPoll == nil || !health.LastPoll.Equal(now) {
+		t.Errorf("ready expected after successful poll, actual: %d %+v", code, health)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if code, health := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable || health.Checks["last_poll"].Ok {
+		t.Errorf("not ready expected when last poll is too old, actual: %d %+v", code, health)
+	}
+}
+
+func TestHealthHandler_BrokerDisconnected(t *testing.T) {
+	now := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  disconnectedPublisher{fakePublisher{msg: make(map[string]interface{})}},
+		Topics:     DefaultTopicLayout("room"),
+		IdleTime:   3 * time.Minute,
+		now:        func() time.Time { return now },
+	}
+	m.recordSuccess(now)
+
+	code, health := getHealth(t, NewHealthHandler([]*Monitor{&m}, 3), "/readyz")
+	if code != http.StatusServiceUnavailable || health.Checks["broker"].Ok || !health.Checks["warmup_login"].Ok {
+		t.Errorf("not ready expected when broker is disconnected, actual: %d %+v", code, health)
+	}
+}
+
+func TestHealthHandler_Accounts(t *testing.T) {
+	now := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	newMonitor := func(name string) *Monitor {
+		return &Monitor{
+			Name:       name,
+			Thermostat: &thermostatMock{},
+			Publisher:  fakePublisher{msg: make(map[string]interface{})},
+			Topics:     DefaultTopicLayout(name),
+			IdleTime:   3 * time.Minute,
+			now:        func() time.Time { return now },
+		}
+	}
+	home, office := newMonitor("home"), newMonitor("office")
+	home.recordSuccess(now)
+	h := NewHealthHandler([]*Monitor{home, office}, 3)
+
+	code, health := getHealth(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || !health.Checks["last_poll.home"].Ok || health.Checks["last_poll.office"].Ok {
+		t.Errorf("not ready expected while an account has not been polled, actual: %d %+v", code, health)
+	}
+	if len(health.Accounts) != 2 || health.Accounts[0].Name != "home" || health.Accounts[0].LastSuccess == nil || health.Accounts[1].LastSuccess != nil {
+		t.Errorf("status of each account expected, actual: %+v", health.Accounts)
+	}
+
+	office.recordSuccess(now)
+	if code, health := getHealth(t, h, "/readyz"); code != http.StatusOK {
+		t.Errorf("ready expected when all accounts are polled, actual: %d %+v", code, health)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// Homie convention version
+const HomieVersion = "4.0"
+
+// Homie device states
+const (
+	HomieInit         = "init"
+	HomieReady        = "ready"
+	HomieDisconnected = "disconnected"
+	// Last will of devices, sent by broker on abrupt disconnection
+	HomieLost = "lost"
+)
+
+// Properties of room nodes
+const (
+	HomieCurrentTemperature = "current-temperature"
+	HomieTargetTemperature  = "target-temperature"
+	HomieRunMode            = "run-mode"
+)
+
+// HomieID return a valid homie id of topic key: lower case ascii letters, digits and '-'
+func HomieID(key string) string {
+	id := strings.Trim(strings.Replace(key, "_", "-", -1), "-")
+	if id == "" {
+		return "unnamed"
+	}
+	return id
+}
+
+// homieDeviceID return id of device of room location, topic base is the homie root topic
+func (l *TopicLayout) homieDeviceID(room *warmup4ie.Room) string {
+	if l.RoomKey == RoomKeyId || room.LocationName == "" {
+		return strconv.Itoa(room.LocationId)
+	}
+	return HomieID(Slug(room.LocationName))
+}
+
+// homieNodeID return id of room node, room names are always slugged as homie ids are restricted to [a-z0-9-]
+func (l *TopicLayout) homieNodeID(room *warmup4ie.Room) string {
+	return HomieID(Slug(l.RoomKeyOf(room)))
+}
+
+// HomieDeviceTopic return topic of device attribute or of device of room when attribute is empty
+func (l *TopicLayout) HomieDeviceTopic(room *warmup4ie.Room, attribute string) string {
+	topic := l.Base + "/" + l.homieDeviceID(room)
+	if attribute != "" {
+		topic += "/" + attribute
+	}
+	return topic
+}
+
+// HomieTopic return topic of node property of room, followed by attribute or set when not empty
+func (l *TopicLayout) HomieTopic(room *warmup4ie.Room, property string, attribute string) string {
+	topic := l.HomieDeviceTopic(room, l.homieNodeID(room))
+	if property != "" {
+		topic += "/" + property
+	}
+	if attribute != "" {
+		topic += "/" + attribute
+	}
+	return topic
+}
+
+// homieMessage is a retained homie topic and its payload
+type homieMessage struct {
+	topic   string
+	payload string
+}
+
+// homieDevices group rooms by homie device id, in the order of rooms
+func (m *Monitor) homieDevices(rooms []warmup4ie.Room) ([]string, map[string][]*warmup4ie.Room) {
+	var ids []string
+	devices := make(map[string][]*warmup4ie.Room)
+	for i := range rooms {
+		id := m.Topics.homieDeviceID(&rooms[i])
+		if _, ok := devices[id]; !ok {
+			ids = append(ids, id)
+		}
+		devices[id] = append(devices[id], &rooms[i])
+	}
+	return ids, devices
+}
+
+// homieDescription return device and node attributes of a location and its rooms
+func (m *Monitor) homieDescription(rooms []*warmup4ie.Room) []homieMessage {
+	location := rooms[0]
+	name := location.LocationName
+	if name == "" {
+		name = "Location " + strconv.Itoa(location.LocationId)
+	}
+	var nodes []string
+	for _, room := range rooms {
+		nodes = append(nodes, m.Topics.homieNodeID(room))
+	}
+	messages := []homieMessage{
+		{m.Topics.HomieDeviceTopic(location, "$homie"), HomieVersion},
+		{m.Topics.HomieDeviceTopic(location, "$name"), name},
+		{m.Topics.HomieDeviceTopic(location, "$nodes"), strings.Join(nodes, ",")},
+		// No extension is supported
+		{m.Topics.HomieDeviceTopic(location, "$extensions"), ""},
+	}
+	settable := strconv.FormatBool(m.Commands)
+	// Only modes that can be set are advertised when commands are enabled
+	runModes := warmup4ie.RunModes()
+	if m.Commands {
+		runModes = warmup4ie.SettableRunModes()
+	}
+	var modes []string
+	for _, mode := range runModes {
+		modes = append(modes, mode.String())
+	}
+	for _, room := range rooms {
+		attribute := func(property string, attribute string, payload string) {
+			messages = append(messages, homieMessage{m.Topics.HomieTopic(room, property, attribute), payload})
+		}
+		attribute("", "$name", room.Name)
+		attribute("", "$type", "thermostat")
+		attribute("", "$properties", strings.Join([]string{HomieCurrentTemperature, HomieTargetTemperature, HomieRunMode}, ","))
+
+		attribute(HomieCurrentTemperature, "$name", "Current temperature")
+		attribute(HomieCurrentTemperature, "$datatype", "float")
+		attribute(HomieCurrentTemperature, "$unit", "°C")
+
+		attribute(HomieTargetTemperature, "$name", "Target temperature")
+		attribute(HomieTargetTemperature, "$datatype", "float")
+		attribute(HomieTargetTemperature, "$unit", "°C")
+		attribute(HomieTargetTemperature, "$settable", settable)
+		if len(room.Thermostat4IES) > 0 {
+			attribute(HomieTargetTemperature, "$format", fmt.Sprintf("%.1f:%.1f",
+				room.Thermostat4IES[0].MinTemp.GetValue(), room.Thermostat4IES[0].MaxTemp.GetValue()))
+		}
+
+		attribute(HomieRunMode, "$name", "Run mode")
+		attribute(HomieRunMode, "$datatype", "enum")
+		attribute(HomieRunMode, "$format", strings.Join(modes, ","))
+		attribute(HomieRunMode, "$settable", settable)
+	}
+	return messages
+}
+
+// HomieStateTopics return $state topics of the homie devices of rooms, in the order of rooms
+func (l *TopicLayout) HomieStateTopics(rooms []warmup4ie.Room) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for i := range rooms {
+		topic := l.HomieDeviceTopic(&rooms[i], "$state")
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// HomieAvailability return availability registering lost state of homie device as last will.
+// Ready state is published on each connection and disconnected state on close.
+func HomieAvailability(stateTopic string) *mqttdevice.Availability {
+	return &mqttdevice.Availability{Topic: stateTopic, Online: HomieReady, Offline: HomieLost, Closed: HomieDisconnected}
+}
+
+// homieWill return availability of the homie device of accounts, their rooms are polled to find the device.
+// A connection has a single last will, nil is returned when accounts have several devices or can't be polled.
+func homieWill(thermostats []warmup4ie.Thermostat, topics []*TopicLayout) *mqttdevice.Availability {
+	var states []string
+	seen := make(map[string]bool)
+	for i, thermostat := range thermostats {
+		rooms, err := thermostat.ListRooms()
+		if err != nil {
+			log.Printf("unable to find homie devices, lost state is not registered as last will: %v\n", err)
+			return nil
+		}
+		for _, topic := range topics[i].HomieStateTopics(*rooms) {
+			if !seen[topic] {
+				seen[topic] = true
+				states = append(states, topic)
+			}
+		}
+	}
+	if len(states) != 1 {
+		log.Printf("%d homie devices, lost state is only registered as last will of a single device\n", len(states))
+		return nil
+	}
+	return HomieAvailability(states[0])
+}
+
+// publishHomie publish rooms as homie devices, one per location with a node per room.
+// Device attributes are published when rooms of the location change, property values on each poll.
+func (m *Monitor) publishHomie(rooms []warmup4ie.Room) error {
+	ids, devices := m.homieDevices(rooms)
+	for _, id := range ids {
+		description := m.homieDescription(devices[id])
+		signature := fmt.Sprint(description)
+		if m.homieDescribed[id] != signature {
+			if err := m.publishHomieDescription(devices[id][0], description); err != nil {
+				return err
+			}
+			if m.homieDescribed == nil {
+				m.homieDescribed = make(map[string]string)
+			}
+			m.homieDescribed[id] = signature
+		}
+		for _, room := range devices[id] {
+			if err := m.publishHomieValues(room); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishHomieDescription publish device attributes surrounded by init and ready states
+func (m *Monitor) publishHomieDescription(location *warmup4ie.Room, description []homieMessage) error {
+	state := m.Topics.HomieDeviceTopic(location, "$state")
+	if err := m.publish(state, HomieInit, nil); err != nil {
+		return err
+	}
+	for _, message := range description {
+		if err := m.publish(message.topic, message.payload, nil); err != nil {
+			return err
+		}
+	}
+	return m.publish(state, HomieReady, nil)
+}
+
+func (m *Monitor) publishHomieValues(room *warmup4ie.Room) error {
+	for _, value := range []struct {
+		property string
+		temp     warmup4ie.Temperature
+	}{
+		{HomieCurrentTemperature, room.CurrentTemp},
+		{HomieTargetTemperature, room.TargetTemp},
+	} {
+		topic := m.Topics.HomieTopic(room, value.property, "")
+		if m.Changes != nil && !m.Changes.ShouldPublish(topic, "", value.temp.GetValue()) {
+			continue
+		}
+		if err := m.publishChange(topic, fmt.Sprintf("%.1f", value.temp.GetValue()), nil); err != nil {
+			return err
+		}
+	}
+	topic := m.Topics.HomieTopic(room, HomieRunMode, "")
+	if m.Changes != nil && !m.Changes.ShouldPublish(topic, room.RunMode.String()) {
+		return nil
+	}
+	return m.publishChange(topic, room.RunMode.String(), nil)
+}
+
+// publishHomieValue publish value applied by a set command on property topic
+func (m *Monitor) publishHomieValue(topic string, value interface{}) {
+	payload := fmt.Sprint(value)
+	if temperature, ok := value.(float32); ok {
+		payload = fmt.Sprintf("%.1f", temperature)
+	}
+	if err := m.publish(topic, payload, nil); err != nil {
+		log.Printf("%sunable to publish homie value: %v\n", m.logPrefix(), err)
+	}
+}
+
+// publishHomieDisconnected publish disconnected state of devices of last poll
+func (m *Monitor) publishHomieDisconnected() {
+	rooms, _ := m.Rooms()
+	ids, devices := m.homieDevices(rooms)
+	for _, id := range ids {
+		if err := m.publish(m.Topics.HomieDeviceTopic(devices[id][0], "$state"), HomieDisconnected, nil); err != nil {
+			log.Printf("%sunable to publish homie state: %v\n", m.logPrefix(), err)
+		}
+	}
+}
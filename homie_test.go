@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+func TestMonitor_PublishHomie(t *testing.T) {
+	m, p := newCommandMonitor()
+	m.Topics = DefaultTopicLayout("homie")
+	m.Payload = PayloadHomie
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for topic, expected := range map[string]string{
+		"homie/0/$homie":                              HomieVersion,
+		"homie/0/$name":                               "Location 0",
+		"homie/0/$state":                              HomieReady,
+		"homie/0/$nodes":                              "room1,room2",
+		"homie/0/room2/$name":                         "Room2",
+		"homie/0/room2/$type":                         "thermostat",
+		"homie/0/room2/$properties":                   "current-temperature,target-temperature,run-mode",
+		"homie/0/room2/current-temperature/$datatype": "float",
+		"homie/0/room2/current-temperature/$unit":     "°C",
+		"homie/0/room2/current-temperature/$settable": "",
+		"homie/0/room2/target-temperature/$settable":  "true",
+		"homie/0/room2/run-mode/$datatype":            "enum",
+		"homie/0/room2/run-mode/$format":              "prog,fixed",
+		"homie/0/room1/current-temperature":           "19.0",
+		"homie/0/room1/target-temperature":            "22.0",
+		"homie/0/room1/run-mode":                      "fixed",
+		"homie/0/room2/run-mode":                      "forced",
+	} {
+		actual, _ := p.msg[topic].(string)
+		if actual != expected {
+			t.Errorf("bad payload on %s, expected: '%s', actual: '%s'", topic, expected, actual)
+		}
+	}
+	if extensions, ok := p.msg["homie/0/$extensions"]; !ok || extensions != "" {
+		t.Errorf("empty extensions expected, actual: %v", extensions)
+	}
+	if p.handlers["homie/0/room1/target-temperature/set"] == nil || p.handlers["homie/0/room2/run-mode/set"] == nil {
+		t.Errorf("homie set topics must be subscribed: %v", p.handlers)
+	}
+
+	// Applied value is published on property topic, without result topic
+	m.handleModeCommand(2, &mqttdevice.Message{Topic: "homie/0/room2/run-mode/set", Payload: []byte("prog")})
+	if p.msg["homie/0/room2/run-mode"] != "prog" || p.msg["homie/0/room2/run-mode/set/result"] != nil {
+		t.Errorf("applied run mode expected on property topic, actual: %v", p.msg["homie/0/room2/run-mode"])
+	}
+
+	m.stop()
+	if p.msg["homie/0/$state"] != HomieDisconnected {
+		t.Errorf("disconnected state expected on stop, actual: %v", p.msg["homie/0/$state"])
+	}
+}
+
+func TestHomieWill(t *testing.T) {
+	topics := DefaultTopicLayout("homie")
+	will := homieWill([]warmup4ie.Thermostat{&thermostatMock{}}, []*TopicLayout{topics})
+	if will == nil || will.Topic != "homie/0/$state" || will.Offline != HomieLost || will.Online != HomieReady || will.Closed != HomieDisconnected {
+		t.Errorf("lost state of device expected as last will, actual: %+v", will)
+	}
+	// A connection has a single last will
+	if will := homieWill([]warmup4ie.Thermostat{&thermostatMock{}, &thermostatMock{}}, []*TopicLayout{topics, DefaultTopicLayout("other")}); will != nil {
+		t.Errorf("no last will expected with several devices, actual: %+v", will)
+	}
+	if will := homieWill([]warmup4ie.Thermostat{&failingThermostat{err: fmt.Errorf("timeout")}}, []*TopicLayout{topics}); will != nil {
+		t.Errorf("no last will expected when rooms can't be polled, actual: %+v", will)
+	}
+}
+
+func TestHomieID(t *testing.T) {
+	for key, expected := range map[string]string{
+		"salle-de-bain": "salle-de-bain",
+		"_living_room":  "living-room",
+		"1234":          "1234",
+		"_":             "unnamed",
+	} {
+		if actual := HomieID(key); actual != expected {
+			t.Errorf("bad homie id of %s, expected: %s, actual: %s", key, expected, actual)
+		}
+	}
+}
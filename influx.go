@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const (
+	DefaultInfluxMeasurement   = "warmup_room"
+	DefaultInfluxFlushInterval = 10 * time.Second
+	DefaultInfluxMaxRetries    = 3
+	DefaultInfluxRetryDelay    = time.Second
+	DefaultInfluxTimeout       = 10 * time.Second
+)
+
+// InfluxSink writes room measurements as line protocol to InfluxDB v2 write api.
+// Points are written by batches, when BatchSize points are pending or every FlushInterval.
+// Failed writes are retried, points are kept until next flush when InfluxDB stays unreachable.
+type InfluxSink struct {
+	// Url of InfluxDB server, ex http://influxdb:8086
+	Url    string
+	Org    string
+	Bucket string
+	Token  string
+	// File containing token, read on each write, replace Token when set
+	TokenFile     string
+	Measurement   string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryDelay    time.Duration
+	MaxPending    int
+	// Count background write failures when set
+	Metrics *Metrics
+	client  *http.Client
+
+	mutex  sync.Mutex
+	buffer batchBuffer
+}
+
+// Write add points of rooms measured at timestamp to the next batch,
+// an error is returned when oldest points are dropped because too many points are pending
+func (s *InfluxSink) Write(account string, rooms []warmup4ie.Room, timestamp time.Time) error {
+	points := make([]interface{}, len(rooms))
+	for i := range rooms {
+		points[i] = s.line(account, &rooms[i], timestamp)
+	}
+	if dropped := s.buffer.add(points, s.BatchSize, s.MaxPending); dropped > 0 {
+		return fmt.Errorf("%d points dropped, too many pending points", dropped)
+	}
+	return nil
+}
+
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+// WriteRooms add points of snapshot rooms to the next batch, failed batches are retried in background
+// and their failures counted in Metrics
+func (s *InfluxSink) WriteRooms(snapshot *RoomSnapshot) error {
+	return s.Write(snapshot.Account, snapshot.Rooms, snapshot.Timestamp)
+}
+
+// WriteEvent does nothing, only room values are written
+func (s *InfluxSink) WriteEvent(event *Event) error {
+	return nil
+}
+
+// line return line protocol of room point
+func (s *InfluxSink) line(account string, room *warmup4ie.Room, timestamp time.Time) string {
+	var buf strings.Builder
+	buf.WriteString(escapeInflux(s.measurement(), ", "))
+	for _, tag := range [][2]string{
+		{"account", account},
+		{"location", room.LocationName},
+		{"location_id", strconv.Itoa(room.LocationId)},
+		{"room", room.Name},
+		{"room_id", strconv.Itoa(room.Id)},
+	} {
+		// Empty tag values are not allowed
+		if tag[1] != "" {
+			fmt.Fprintf(&buf, ",%s=%s", tag[0], escapeInflux(tag[1], ",= "))
+		}
+	}
+	fmt.Fprintf(&buf, " current=%s,target=%s,run_mode=\"%s\",run_mode_id=%di %d",
+		strconv.FormatFloat(float64(room.CurrentTemp.GetValue()), 'f', -1, 32),
+		strconv.FormatFloat(float64(room.TargetTemp.GetValue()), 'f', -1, 32),
+		escapeInflux(room.RunMode.String(), `"\`),
+		int(room.RunMode),
+		timestamp.Unix())
+	return buf.String()
+}
+
+// escapeInflux escape special characters with a backslash
+func escapeInflux(value string, special string) string {
+	var buf strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(special, r) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// Run flush pending points by batches until ctx is cancelled, remaining points are written by Close
+func (s *InfluxSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.flushInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.buffer.fullChan():
+		}
+		if err := s.Flush(ctx, s.maxRetries()); err != nil {
+			log.Printf("influxdb: %v\n", err)
+			s.sinkError()
+		}
+	}
+}
+
+// Close write pending points without retry
+func (s *InfluxSink) Close() {
+	if err := s.Flush(context.Background(), 0); err != nil {
+		log.Printf("influxdb: pending points not written: %v\n", err)
+		s.sinkError()
+	}
+}
+
+// Flush write pending points by batches, failed batch and following points are kept for next flush
+// Points rejected by InfluxDB are dropped, they would be rejected again
+func (s *InfluxSink) Flush(ctx context.Context, retries int) error {
+	return s.buffer.flush(s.BatchSize, func(batch []interface{}) error {
+		lines := make([]string, len(batch))
+		for i := range batch {
+			lines[i] = batch[i].(string)
+		}
+		err := s.writeRetry(ctx, lines, retries)
+		if err != nil && !isRetryable(err) {
+			log.Printf("influxdb: %d points dropped: %v\n", len(batch), err)
+			s.sinkError()
+			return nil
+		}
+		return err
+	})
+}
+
+// sinkError count a background write failure
+func (s *InfluxSink) sinkError() {
+	if s.Metrics != nil {
+		s.Metrics.SinkError(s.Name())
+	}
+}
+
+func (s *InfluxSink) writeRetry(ctx context.Context, batch []string, retries int) error {
+	delay := s.retryDelay()
+	for attempt := 0; ; attempt++ {
+		err := s.write(ctx, batch)
+		if err == nil || !isRetryable(err) || attempt >= retries {
+			return err
+		}
+		log.Printf("influxdb: write failed, retry in %v: %v\n", delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// InfluxError is the error of a write rejected by InfluxDB
+type InfluxError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *InfluxError) Error() string {
+	return fmt.Sprintf("write rejected with status %d: %s", e.StatusCode, e.Message)
+}
+
+// isRetryable return false when InfluxDB rejected the points, they would be rejected again
+func isRetryable(err error) bool {
+	e, ok := err.(*InfluxError)
+	return !ok || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (s *InfluxSink) write(ctx context.Context, batch []string) error {
+	token, err := s.token()
+	if err != nil {
+		return err
+	}
+	query := url.Values{"org": {s.Org}, "bucket": {s.Bucket}, "precision": {"s"}}
+	body := strings.Join(batch, "\n")
+	request, err := http.NewRequest(http.MethodPost, strings.TrimRight(s.Url, "/")+"/api/v2/write?"+query.Encode(), bytes.NewBufferString(body))
+	if err != nil {
+		return fmt.Errorf("unable to build write request: %w", err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+	response, err := s.httpClient().Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to write points: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return &InfluxError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
+
+func (s *InfluxSink) token() (string, error) {
+	if s.TokenFile == "" {
+		return s.Token, nil
+	}
+	content, err := ioutil.ReadFile(s.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file: %w", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func (s *InfluxSink) httpClient() *http.Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		s.client = &http.Client{Timeout: DefaultInfluxTimeout}
+	}
+	return s.client
+}
+
+func (s *InfluxSink) measurement() string {
+	if s.Measurement == "" {
+		return DefaultInfluxMeasurement
+	}
+	return s.Measurement
+}
+
+func (s *InfluxSink) flushInterval() time.Duration {
+	if s.FlushInterval <= 0 {
+		return DefaultInfluxFlushInterval
+	}
+	return s.FlushInterval
+}
+
+func (s *InfluxSink) maxRetries() int {
+	if s.MaxRetries < 0 {
+		return 0
+	}
+	return s.MaxRetries
+}
+
+func (s *InfluxSink) retryDelay() time.Duration {
+	if s.RetryDelay <= 0 {
+		return DefaultInfluxRetryDelay
+	}
+	return s.RetryDelay
+}
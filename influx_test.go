@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+type influxServer struct {
+	mutex    sync.Mutex
+	statuses []int
+	writes   []string
+	queries  []string
+}
+
+func (s *influxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.queries = append(s.queries, r.URL.Path+"?"+r.URL.RawQuery+" "+r.Header.Get("Authorization"))
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	s.writes = append(s.writes, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *influxServer) written() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.writes...)
+}
+
+func TestInfluxSink_Line(t *testing.T) {
+	s := InfluxSink{}
+	room := warmup4ie.Room{
+		Id:           1234,
+		Name:         "Salle de bain",
+		RunMode:      warmup4ie.RunModeFixed,
+		LocationId:   1,
+		LocationName: "Home, sweet=home",
+		CurrentTemp:  warmup4ie.Temperature{RawTemperature: 195},
+		TargetTemp:   warmup4ie.Temperature{RawTemperature: 220},
+	}
+	line := s.line("home", &room, time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC))
+	expected := `warmup_room,account=home,location=Home\,\ sweet\=home,location_id=1,room=Salle\ de\ bain,room_id=1234 current=19.5,target=22,run_mode="fixed",run_mode_id=3i 1572690600`
+	if line != expected {
+		t.Errorf("bad line protocol\nexpected: %s\nactual:   %s", expected, line)
+	}
+}
+
+func TestInfluxSink_Batch(t *testing.T) {
+	server := influxServer{}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	s := InfluxSink{Url: httpServer.URL, Org: "home", Bucket: "warmup", Token: "secret", BatchSize: 2, FlushInterval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	s.Write("home", *rooms, time.Now())
+	deadline := time.Now().Add(time.Second)
+	for len(server.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch must be written when full")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writes := server.written()
+	if len(writes) != 1 || strings.Count(writes[0], "\n") != 1 || !strings.Contains(writes[0], "room=Room2") {
+		t.Errorf("2 points expected in batch, actual: %v", writes)
+	}
+	if server.queries[0] != "/api/v2/write?bucket=warmup&org=home&precision=s Token secret" {
+		t.Errorf("bad write request: %v", server.queries[0])
+	}
+}
+
+func TestInfluxSink_Retry(t *testing.T) {
+	server := influxServer{statuses: []int{http.StatusServiceUnavailable, http.StatusNoContent, http.StatusBadRequest}}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	s := InfluxSink{Url: httpServer.URL, Org: "home", Bucket: "warmup", BatchSize: 1, RetryDelay: time.Millisecond, Metrics: NewMetrics()}
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	s.Write("home", *rooms, time.Now())
+
+	// First point is written after a retry, second one is rejected and dropped
+	if err := s.Flush(context.Background(), 1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if writes := server.written(); len(writes) != 1 || !strings.Contains(writes[0], "room=Room1") {
+		t.Errorf("first point expected after retry, actual: %v", writes)
+	}
+	if len(s.buffer.pending) != 0 {
+		t.Errorf("rejected point must be dropped, actual: %v", s.buffer.pending)
+	}
+	if s.Metrics.sinkErrors["influxdb"] != 1 {
+		t.Errorf("dropped point must be counted as sink error, actual: %v", s.Metrics.sinkErrors)
+	}
+
+	server.statuses = []int{http.StatusServiceUnavailable}
+	s.Write("home", (*rooms)[:1], time.Now())
+	if err := s.Flush(context.Background(), 0); err == nil {
+		t.Errorf("error expected when InfluxDB is unavailable")
+	}
+	if len(s.buffer.pending) != 1 {
+		t.Errorf("point must be kept for next flush, actual: %v", s.buffer.pending)
+	}
+	s.Close()
+	if len(s.buffer.pending) != 0 || len(server.written()) != 2 {
+		t.Errorf("pending point must be written on close, actual: %v", server.written())
+	}
+}
+
+func TestInfluxSink_MaxPending(t *testing.T) {
+	s := InfluxSink{MaxPending: 1}
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	err := s.WriteRooms(&RoomSnapshot{Account: "home", Rooms: *rooms, Timestamp: time.Now()})
+	if err == nil || err.Error() != "1 points dropped, too many pending points" {
+		t.Errorf("error expected when points are dropped, actual: %v", err)
+	}
+	if len(s.buffer.pending) != 1 || !strings.Contains(s.buffer.pending[0].(string), "room=Room2") {
+		t.Errorf("oldest point must be dropped, actual: %v", s.buffer.pending)
+	}
+}
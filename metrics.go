@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const metricsPrefix = "warmup4ie2mqtt_"
+
+// Upper bounds in seconds of duration histograms buckets
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics collects room values and internal metrics by warmup account, exposed in prometheus text format
+type Metrics struct {
+	mutex         sync.Mutex
+	rooms         map[string][]warmup4ie.Room
+	requests      map[requestKey]*histogram
+	logins        map[string]uint64
+	polls         map[string]*histogram
+	pollFailures  map[string]uint64
+	publishErrors uint64
+	sinkErrors    map[string]uint64
+	// Connections by broker name
+	connections map[string]uint64
+}
+
+type requestKey struct {
+	account string
+	method  string
+	status  string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rooms:        make(map[string][]warmup4ie.Room),
+		requests:     make(map[requestKey]*histogram),
+		logins:       make(map[string]uint64),
+		polls:        make(map[string]*histogram),
+		pollFailures: make(map[string]uint64),
+		sinkErrors:   make(map[string]uint64),
+		connections:  make(map[string]uint64),
+	}
+}
+
+// RequestObserver return observer recording requests sent to warmup api with account
+func (m *Metrics) RequestObserver(account string) warmup4ie.RequestObserver {
+	return func(method string, statusCode int, duration time.Duration) {
+		m.ObserveRequest(account, method, statusCode, duration)
+	}
+}
+
+// ObserveRequest record a request sent to warmup api
+func (m *Metrics) ObserveRequest(account string, method string, statusCode int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := "error"
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	key := requestKey{account: account, method: method, status: status}
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{}
+		m.requests[key] = h
+	}
+	h.observe(duration.Seconds())
+	if method == "userLogin" {
+		m.logins[account]++
+	}
+}
+
+// ObservePoll record duration and result of a poll
+func (m *Metrics) ObservePoll(account string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.polls[account]
+	if !ok {
+		h = &histogram{}
+		m.polls[account] = h
+	}
+	h.observe(duration.Seconds())
+	if err != nil {
+		m.pollFailures[account]++
+	}
+}
+
+// ObserveRooms replace room values of account by the ones of the last poll
+func (m *Metrics) ObserveRooms(account string, rooms []warmup4ie.Room) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rooms[account] = append([]warmup4ie.Room(nil), rooms...)
+}
+
+func (m *Metrics) Name() string {
+	return "metrics"
+}
+
+// WriteRooms replace room values of account by the ones of snapshot
+func (m *Metrics) WriteRooms(snapshot *RoomSnapshot) error {
+	m.ObserveRooms(snapshot.Account, snapshot.Rooms)
+	return nil
+}
+
+// WriteEvent does nothing, events are not collected
+func (m *Metrics) WriteEvent(event *Event) error {
+	return nil
+}
+
+// SinkError record a write error of sink
+func (m *Metrics) SinkError(sink string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sinkErrors[sink]++
+}
+
+func (m *Metrics) PublishError() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.publishErrors++
+}
+
+// Connected must be called on each connection to the single broker, reconnections are the connections after the first one
+func (m *Metrics) Connected() {
+	m.BrokerConnected("")
+}
+
+// BrokerConnected must be called on each connection to a broker, reconnections are the connections after the first one of each broker
+func (m *Metrics) BrokerConnected(broker string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.connections[broker]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(m.Bytes()); err != nil {
+		log.Printf("unable to write metrics: %v\n", err)
+	}
+}
+
+// Bytes return metrics in prometheus text format
+func (m *Metrics) Bytes() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var buf bytes.Buffer
+	accounts := make([]string, 0, len(m.rooms))
+	for account := range m.rooms {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	writeHeader(&buf, "room_current_temperature_celsius", "gauge", "Current floor temperature of room")
+	for _, account := range accounts {
+		for _, room := range m.rooms[account] {
+			writeSample(&buf, "room_current_temperature_celsius", roomLabels(account, &room), float64(room.CurrentTemp.GetValue()))
+		}
+	}
+	writeHeader(&buf, "room_target_temperature_celsius", "gauge", "Target floor temperature of room")
+	for _, account := range accounts {
+		for _, room := range m.rooms[account] {
+			writeSample(&buf, "room_target_temperature_celsius", roomLabels(account, &room), float64(room.TargetTemp.GetValue()))
+		}
+	}
+	writeHeader(&buf, "room_run_mode", "gauge", "Run mode of room, 1 for the current mode")
+	for _, account := range accounts {
+		for _, room := range m.rooms[account] {
+			for mode := warmup4ie.RunModeOff; mode <= warmup4ie.RunModeAway; mode++ {
+				value := 0.0
+				if room.RunMode == mode {
+					value = 1
+				}
+				writeSample(&buf, "room_run_mode", append(roomLabels(account, &room), "mode", mode.String()), value)
+			}
+		}
+	}
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].account != keys[j].account {
+			return keys[i].account < keys[j].account
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	writeHeader(&buf, "warmup_requests_total", "counter", "Requests sent to warmup api by method and http status")
+	for _, key := range keys {
+		writeSample(&buf, "warmup_requests_total", []string{"account", key.account, "method", key.method, "status", key.status}, float64(m.requests[key].count))
+	}
+	writeHeader(&buf, "warmup_request_duration_seconds", "histogram", "Latency of requests sent to warmup api")
+	for _, key := range keys {
+		writeHistogram(&buf, "warmup_request_duration_seconds", []string{"account", key.account, "method", key.method, "status", key.status}, m.requests[key])
+	}
+	writeHeader(&buf, "warmup_logins_total", "counter", "Logins to warmup api")
+	for _, account := range sortedKeys(m.logins) {
+		writeSample(&buf, "warmup_logins_total", []string{"account", account}, float64(m.logins[account]))
+	}
+
+	polled := make([]string, 0, len(m.polls))
+	for account := range m.polls {
+		polled = append(polled, account)
+	}
+	sort.Strings(polled)
+	writeHeader(&buf, "poll_duration_seconds", "histogram", "Duration of thermostat polls")
+	for _, account := range polled {
+		writeHistogram(&buf, "poll_duration_seconds", []string{"account", account}, m.polls[account])
+	}
+	writeHeader(&buf, "poll_failures_total", "counter", "Failed thermostat polls")
+	for _, account := range polled {
+		writeSample(&buf, "poll_failures_total", []string{"account", account}, float64(m.pollFailures[account]))
+	}
+
+	writeHeader(&buf, "mqtt_publish_errors_total", "counter", "Messages that couldn't be published to broker")
+	writeSample(&buf, "mqtt_publish_errors_total", nil, float64(m.publishErrors))
+	writeHeader(&buf, "sink_errors_total", "counter", "Write errors of outputs, mqtt for the broker")
+	for _, sink := range sortedKeys(m.sinkErrors) {
+		writeSample(&buf, "sink_errors_total", []string{"sink", sink}, float64(m.sinkErrors[sink]))
+	}
+	var reconnects uint64
+	for _, connections := range m.connections {
+		if connections > 0 {
+			reconnects += connections - 1
+		}
+	}
+	writeHeader(&buf, "mqtt_reconnects_total", "counter", "Reconnections to broker")
+	writeSample(&buf, "mqtt_reconnects_total", nil, float64(reconnects))
+	return buf.Bytes()
+}
+
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func roomLabels(account string, room *warmup4ie.Room) []string {
+	return []string{
+		"account", account,
+		"room_id", strconv.Itoa(room.Id),
+		"room", room.Name,
+		"location_id", strconv.Itoa(room.LocationId),
+		"location", room.LocationName,
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(buf, "# TYPE %s%s %s\n", metricsPrefix, name, metricType)
+}
+
+// writeSample write one sample, labels are name and value pairs
+func writeSample(buf *bytes.Buffer, name string, labels []string, value float64) {
+	buf.WriteString(metricsPrefix)
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, `%s="%s"`, labels[i], escapeLabel(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteByte('\n')
+}
+
+func writeHistogram(buf *bytes.Buffer, name string, labels []string, h *histogram) {
+	for i, bound := range durationBuckets {
+		var count uint64
+		if h.buckets != nil {
+			count = h.buckets[i]
+		}
+		writeSample(buf, name+"_bucket", append(labels[:len(labels):len(labels)], "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(count))
+	}
+	writeSample(buf, name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	writeSample(buf, name+"_sum", labels, h.sum)
+	writeSample(buf, name+"_count", labels, float64(h.count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	m := Monitor{
+		Name:       "home",
+		Thermostat: &thermostatMock{},
+		Publisher:  failingPublisher{},
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadTopics,
+		Metrics:    metrics,
+		Sinks:      []Sink{metrics},
+	}
+	if err := m.poll(); err != nil {
+		t.Errorf("publish errors must not fail the poll: %v", err)
+	}
+	metrics.RequestObserver("home")("getRooms", 200, 300*time.Millisecond)
+	metrics.ObserveRequest("office", "userLogin", 0, time.Second)
+	metrics.ObservePoll("home", 2*time.Second, nil)
+	metrics.Connected()
+	metrics.Connected()
+	// First connection of other brokers is not a reconnection
+	metrics.BrokerConnected("local")
+	metrics.BrokerConnected("remote")
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	content := w.Body.String()
+	for _, expected := range []string{
+		"# TYPE warmup4ie2mqtt_room_current_temperature_celsius gauge\n",
+		`warmup4ie2mqtt_room_current_temperature_celsius{account="home",room_id="1",room="Room1",location_id="0",location=""} 19` + "\n",
+		`warmup4ie2mqtt_room_target_temperature_celsius{account="home",room_id="2",room="Room2",location_id="0",location=""} 25` + "\n",
+		`warmup4ie2mqtt_room_run_mode{account="home",room_id="1",room="Room1",location_id="0",location="",mode="fixed"} 1` + "\n",
+		`warmup4ie2mqtt_room_run_mode{account="home",room_id="1",room="Room1",location_id="0",location="",mode="prog"} 0` + "\n",
+		`warmup4ie2mqtt_warmup_requests_total{account="home",method="getRooms",status="200"} 1` + "\n",
+		`warmup4ie2mqtt_warmup_request_duration_seconds_bucket{account="home",method="getRooms",status="200",le="0.25"} 0` + "\n",
+		`warmup4ie2mqtt_warmup_request_duration_seconds_bucket{account="home",method="getRooms",status="200",le="0.5"} 1` + "\n",
+		`warmup4ie2mqtt_warmup_request_duration_seconds_bucket{account="office",method="userLogin",status="error",le="+Inf"} 1` + "\n",
+		`warmup4ie2mqtt_warmup_logins_total{account="office"} 1` + "\n",
+		`warmup4ie2mqtt_poll_duration_seconds_sum{account="home"} 2` + "\n",
+		`warmup4ie2mqtt_poll_duration_seconds_count{account="home"} 1` + "\n",
+		"warmup4ie2mqtt_mqtt_publish_errors_total 1\n",
+		`warmup4ie2mqtt_sink_errors_total{sink="mqtt"} 1` + "\n",
+		"warmup4ie2mqtt_mqtt_reconnects_total 1\n",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("metric %s not found in:\n%s", expected, content)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Errorf("bad escaped label: %s", escaped)
+	}
+}
@@ -0,0 +1,38 @@
+package mqttdevice
+
+const (
+	DefaultOnlinePayload  = "online"
+	DefaultOfflinePayload = "offline"
+)
+
+// Availability describes the retained message telling subscribers if the bridge is connected.
+// Online payload is published on each connection, offline payload is published on Close
+// and registered as last will to be sent by the broker on abrupt disconnection.
+type Availability struct {
+	Topic   string
+	Online  string
+	Offline string
+	// Published on Close instead of offline payload when set, offline payload is only the last will
+	Closed string
+}
+
+func (a *Availability) online() string {
+	if a.Online == "" {
+		return DefaultOnlinePayload
+	}
+	return a.Online
+}
+
+func (a *Availability) offline() string {
+	if a.Offline == "" {
+		return DefaultOfflinePayload
+	}
+	return a.Offline
+}
+
+func (a *Availability) closed() string {
+	if a.Closed == "" {
+		return a.offline()
+	}
+	return a.Closed
+}
@@ -0,0 +1,349 @@
+package mqttdevice
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Properties are MQTT 5 properties of a published message, ignored by MQTT 3 publishers
+type Properties struct {
+	// Broker drops the message if not delivered before expiry, 0 to keep message forever
+	MessageExpiry   time.Duration
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  map[string]string
+}
+
+// PropertiesPublisher is implemented by publishers supporting MQTT 5 properties
+type PropertiesPublisher interface {
+	PublishWithProperties(topic string, payload interface{}, properties *Properties) error
+}
+
+// Paho5MqttPublisher publish messages with MQTT 5 protocol
+type Paho5MqttPublisher struct {
+	Uri      string
+	Username string
+	Password string
+	ClientId string
+	Qos      int
+	Retain   bool
+	// Replace topics by aliases when allowed by broker
+	TopicAliases bool
+	// Maximum time to wait for connection and acknowledgements
+	Timeout time.Duration
+	// Retained online/offline message, nil to disable
+	Availability *Availability
+	// Certificates used with tls:// brokers, system ones when nil
+	TLSConfig *tls.Config
+	// Replace Username and Password when set
+	Credentials CredentialsProvider
+
+	cm      *autopaho.ConnectionManager
+	router  *paho.StandardRouter
+	aliases *topicAliases
+
+	mutex         sync.Mutex
+	connected     bool
+	subscriptions map[string]MessageHandler
+	onConnect     []func()
+}
+
+// Publish message to broker
+func (p *Paho5MqttPublisher) Publish(topic string, payload interface{}) error {
+	return p.PublishWithProperties(topic, payload, nil)
+}
+
+// PublishWithProperties publish message to broker with MQTT 5 properties
+func (p *Paho5MqttPublisher) PublishWithProperties(topic string, payload interface{}, properties *Properties) error {
+	msg := paho.Publish{
+		QoS:        byte(p.Qos),
+		Retain:     p.Retain,
+		Topic:      topic,
+		Payload:    toBytes(payload),
+		Properties: toPahoProperties(properties),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	if _, err := p.cm.Publish(ctx, &msg); err != nil {
+		return fmt.Errorf("unable to publish message on topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// IsConnected return true if connection to broker is up
+func (p *Paho5MqttPublisher) IsConnected() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.connected
+}
+
+func (p *Paho5MqttPublisher) setConnected(connected bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.connected = connected
+}
+
+// OnConnect register handler called after each (re)connection to broker
+func (p *Paho5MqttPublisher) OnConnect(handler func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.onConnect = append(p.onConnect, handler)
+}
+
+// Close publish offline availability and disconnect from broker
+func (p *Paho5MqttPublisher) Close() {
+	if p.Availability != nil {
+		if err := p.publishRetained(p.cm, p.Availability.Topic, p.Availability.closed()); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	p.setConnected(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := p.cm.Disconnect(ctx); err != nil {
+		log.Printf("unable to disconnect from broker: %v\n", err)
+	}
+}
+
+func (p *Paho5MqttPublisher) publishRetained(cm *autopaho.ConnectionManager, topic string, payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	msg := paho.Publish{QoS: byte(p.Qos), Retain: true, Topic: topic, Payload: []byte(payload)}
+	if _, err := cm.Publish(ctx, &msg); err != nil {
+		return fmt.Errorf("unable to publish message on topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Connect to broker, connection is retried in background when broker is unreachable.
+// Messages can't be published until connected, they are kept by a QueuedPublisher.
+func (p *Paho5MqttPublisher) Connect() {
+	if p.cm != nil {
+		return
+	}
+	brokerUrl, err := url.Parse(p.Uri)
+	if err != nil {
+		panic(fmt.Errorf("invalid broker uri %s: %w", p.Uri, err))
+	}
+
+	p.router = paho.NewStandardRouter()
+	p.aliases = &topicAliases{enabled: p.TopicAliases}
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:     []*url.URL{brokerUrl},
+		TlsCfg:         p.TLSConfig,
+		KeepAlive:      30,
+		ConnectTimeout: p.timeout(),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			p.aliases.reset(connack)
+			p.setConnected(true)
+			p.onConnected(cm)
+		},
+		OnConnectError: func(err error) {
+			log.Printf("unable to connect to broker %s: %v\n", p.Uri, err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:    p.ClientId,
+			Router:      p.router,
+			PublishHook: p.aliases.apply,
+			OnClientError: func(err error) {
+				log.Printf("connection to broker %s lost: %v\n", p.Uri, err)
+				p.setConnected(false)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				log.Printf("disconnected by broker %s, reason code %d\n", p.Uri, disconnect.ReasonCode)
+				p.setConnected(false)
+			},
+		},
+	}
+	cfg.SetUsernamePassword(p.Username, []byte(p.Password))
+	if p.Credentials != nil {
+		cfg.SetConnectPacketConfigurator(p.setCredentials)
+	}
+	if p.Availability != nil {
+		cfg.SetWillMessage(p.Availability.Topic, []byte(p.Availability.offline()), byte(p.Qos), true)
+	}
+
+	p.cm, err = autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	if err := p.cm.AwaitConnection(ctx); err != nil {
+		// Connection manager keeps connecting, messages can't be published until connected
+		log.Printf("broker %s not connected after %v, connection is retried in background\n", p.Uri, p.timeout())
+	}
+}
+
+// Subscribe to topic, subscription is restored after reconnection. Subscribing again to a topic replaces its handler.
+func (p *Paho5MqttPublisher) Subscribe(topic string, handler MessageHandler) error {
+	p.register(topic, handler)
+	return p.subscribe(p.cm, topic)
+}
+
+// register handler of topic, the router handler is registered once per topic as the router appends handlers
+func (p *Paho5MqttPublisher) register(topic string, handler MessageHandler) {
+	p.mutex.Lock()
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[string]MessageHandler)
+	}
+	_, registered := p.subscriptions[topic]
+	p.subscriptions[topic] = handler
+	p.mutex.Unlock()
+	if registered {
+		return
+	}
+	p.router.RegisterHandler(topic, func(msg *paho.Publish) {
+		p.mutex.Lock()
+		handler := p.subscriptions[topic]
+		p.mutex.Unlock()
+		handler(fromPahoPublish(msg))
+	})
+}
+
+func (p *Paho5MqttPublisher) subscribe(cm *autopaho.ConnectionManager, topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{topic: {QoS: byte(p.Qos)}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+func (p *Paho5MqttPublisher) onConnected(cm *autopaho.ConnectionManager) {
+	if p.Availability != nil {
+		if err := p.publishRetained(cm, p.Availability.Topic, p.Availability.online()); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	p.mutex.Lock()
+	topics := make([]string, 0, len(p.subscriptions))
+	for topic := range p.subscriptions {
+		topics = append(topics, topic)
+	}
+	handlers := p.onConnect
+	p.mutex.Unlock()
+
+	// Subscribe without holding the mutex, message handlers read subscriptions
+	for _, topic := range topics {
+		if err := p.subscribe(cm, topic); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// setCredentials replace credentials of connect packet by the ones of provider, configured ones are kept if provider fails
+func (p *Paho5MqttPublisher) setCredentials(connect *paho.Connect) *paho.Connect {
+	username, password, err := p.Credentials()
+	if err != nil {
+		log.Printf("unable to read broker credentials: %v\n", err)
+		return connect
+	}
+	connect.Username, connect.UsernameFlag = username, username != ""
+	connect.Password, connect.PasswordFlag = []byte(password), password != ""
+	return connect
+}
+
+func (p *Paho5MqttPublisher) timeout() time.Duration {
+	return timeoutOrDefault(p.Timeout)
+}
+
+func toBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case string:
+		return []byte(p)
+	default:
+		return []byte(fmt.Sprintf("%v", p))
+	}
+}
+
+func toPahoProperties(properties *Properties) *paho.PublishProperties {
+	if properties == nil {
+		return nil
+	}
+	result := paho.PublishProperties{
+		ContentType:     properties.ContentType,
+		ResponseTopic:   properties.ResponseTopic,
+		CorrelationData: properties.CorrelationData,
+	}
+	if properties.MessageExpiry > 0 {
+		expiry := uint32(properties.MessageExpiry / time.Second)
+		result.MessageExpiry = &expiry
+	}
+	// Sort user properties to publish them in a stable order
+	keys := make([]string, 0, len(properties.UserProperties))
+	for k := range properties.UserProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result.User.Add(k, properties.UserProperties[k])
+	}
+	return &result
+}
+
+func fromPahoPublish(msg *paho.Publish) *Message {
+	result := Message{Topic: msg.Topic, Payload: msg.Payload}
+	if msg.Properties != nil {
+		result.ResponseTopic = msg.Properties.ResponseTopic
+		result.CorrelationData = msg.Properties.CorrelationData
+	}
+	return &result
+}
+
+// topicAliases replace topics already sent on the current connection by their alias
+type topicAliases struct {
+	enabled bool
+	mutex   sync.Mutex
+	max     uint16
+	aliases map[string]uint16
+}
+
+func (t *topicAliases) reset(connack *paho.Connack) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.max = 0
+	t.aliases = make(map[string]uint16)
+	if t.enabled && connack != nil && connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		t.max = *connack.Properties.TopicAliasMaximum
+	}
+}
+
+func (t *topicAliases) apply(msg *paho.Publish) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.max == 0 {
+		return
+	}
+	if msg.Properties == nil {
+		msg.Properties = &paho.PublishProperties{}
+	}
+	if alias, ok := t.aliases[msg.Topic]; ok {
+		msg.Properties.TopicAlias = &alias
+		msg.Topic = ""
+		return
+	}
+	if len(t.aliases) < int(t.max) {
+		alias := uint16(len(t.aliases) + 1)
+		t.aliases[msg.Topic] = alias
+		msg.Properties.TopicAlias = &alias
+	}
+}
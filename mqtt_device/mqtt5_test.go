@@ -0,0 +1,84 @@
+package mqttdevice
+
+import (
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"testing"
+	"time"
+)
+
+func TestToPahoProperties(t *testing.T) {
+	if toPahoProperties(nil) != nil {
+		t.Errorf("nil properties expected")
+	}
+
+	props := toPahoProperties(&Properties{
+		MessageExpiry:   10 * time.Minute,
+		ContentType:     "application/json",
+		CorrelationData: []byte("1234"),
+		UserProperties:  map[string]string{"unit": "°C", "room_id": "5678"},
+	})
+	if props.MessageExpiry == nil || *props.MessageExpiry != 600 {
+		t.Errorf("bad message expiry: %v", props.MessageExpiry)
+	}
+	if props.ContentType != "application/json" || string(props.CorrelationData) != "1234" {
+		t.Errorf("bad properties: %+v", props)
+	}
+	if len(props.User) != 2 || props.User[0].Key != "room_id" || props.User[1].Value != "°C" {
+		t.Errorf("bad user properties: %+v", props.User)
+	}
+}
+
+func TestTopicAliases(t *testing.T) {
+	max := uint16(1)
+	aliases := topicAliases{enabled: true}
+	aliases.reset(&paho.Connack{Properties: &paho.ConnackProperties{TopicAliasMaximum: &max}})
+
+	first := paho.Publish{Topic: "room/room1/state"}
+	aliases.apply(&first)
+	if first.Topic != "room/room1/state" || *first.Properties.TopicAlias != 1 {
+		t.Errorf("topic and new alias expected: %+v", first)
+	}
+
+	second := paho.Publish{Topic: "room/room1/state"}
+	aliases.apply(&second)
+	if second.Topic != "" || *second.Properties.TopicAlias != 1 {
+		t.Errorf("only alias expected: %+v", second)
+	}
+
+	other := paho.Publish{Topic: "room/room2/state"}
+	aliases.apply(&other)
+	if other.Topic != "room/room2/state" || other.Properties.TopicAlias != nil {
+		t.Errorf("no alias expected when maximum is reached: %+v", other)
+	}
+
+	aliases.reset(&paho.Connack{})
+	third := paho.Publish{Topic: "room/room1/state"}
+	aliases.apply(&third)
+	if third.Topic != "room/room1/state" || third.Properties != nil {
+		t.Errorf("aliases must be reset on new connection: %+v", third)
+	}
+}
+
+func TestFromPahoPublish(t *testing.T) {
+	msg := fromPahoPublish(&paho.Publish{
+		Topic:      "room/room1/mode/set",
+		Payload:    []byte("prog"),
+		Properties: &paho.PublishProperties{ResponseTopic: "client/response", CorrelationData: []byte("42")},
+	})
+	if msg.Topic != "room/room1/mode/set" || string(msg.Payload) != "prog" || msg.ResponseTopic != "client/response" || string(msg.CorrelationData) != "42" {
+		t.Errorf("bad message: %+v", msg)
+	}
+}
+
+func TestPaho5MqttPublisher_RegisterOnce(t *testing.T) {
+	p := Paho5MqttPublisher{router: paho.NewStandardRouter()}
+	var calls []string
+	p.register("room/+/mode/set", func(msg *Message) { calls = append(calls, "first") })
+	// Retried subscription or resubscription replaces the handler
+	p.register("room/+/mode/set", func(msg *Message) { calls = append(calls, "second") })
+	p.router.Route(&packets.Publish{Topic: "room/room1/mode/set", Payload: []byte("prog"), Properties: &packets.Properties{}})
+	if len(calls) != 1 || calls[0] != "second" {
+		t.Errorf("message must be handled once by the last handler, actual: %v", calls)
+	}
+}
@@ -1,15 +1,63 @@
 package mqttdevice
 
 import (
+	"crypto/tls"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"log"
+	"sync"
+	"time"
 )
 
 type Publisher interface {
 	Connect()
 	Close()
-	Publish(topic string, payload interface{})
+	Publish(topic string, payload interface{}) error
+}
+
+// NopPublisher discards messages, used when no broker is configured
+type NopPublisher struct{}
+
+func (NopPublisher) Connect() {}
+
+func (NopPublisher) Close() {}
+
+func (NopPublisher) Publish(topic string, payload interface{}) error {
+	return nil
+}
+
+// ConnectionNotifier is implemented by publishers able to notify (re)connections to broker
+type ConnectionNotifier interface {
+	OnConnect(handler func())
+}
+
+// BrokerConnectionNotifier is implemented by publishers connected to several brokers, handler receives the name of the broker
+type BrokerConnectionNotifier interface {
+	OnBrokerConnect(handler func(broker string))
+}
+
+// ConnectionChecker is implemented by publishers able to report the state of the connection to broker
+type ConnectionChecker interface {
+	IsConnected() bool
+}
+
+// CredentialsProvider return username and password, called on each connection to use up to date credentials
+type CredentialsProvider func() (username string, password string, err error)
+
+// Message received from broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Request/response properties, only available with MQTT 5
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+type MessageHandler func(msg *Message)
+
+// Subscriber is implemented by publishers able to receive messages
+type Subscriber interface {
+	Subscribe(topic string, handler MessageHandler) error
 }
 
 type PahoMqttPublisher struct {
@@ -19,43 +67,219 @@ type PahoMqttPublisher struct {
 	ClientId string
 	Oos      int
 	Retain   bool
-	client   MQTT.Client
+	// Maximum time to wait for publication acknowledgement
+	Timeout time.Duration
+	// Retained online/offline message, nil to disable
+	Availability *Availability
+	// Certificates used with ssl:// and tls:// brokers, system ones when nil
+	TLSConfig *tls.Config
+	// Replace Username and Password when set
+	Credentials CredentialsProvider
+	// Delay between connection attempts while broker is unreachable at startup, DefaultConnectRetryDelay when 0
+	RetryDelay time.Duration
+	client     MQTT.Client
+
+	mutex         sync.Mutex
+	subscriptions map[string]MessageHandler
+	onConnect     []func()
+	closed        bool
 }
 
 // Publish message to broker
-func (p *PahoMqttPublisher) Publish(topic string, payload interface{}) {
+func (p *PahoMqttPublisher) Publish(topic string, payload interface{}) error {
+	// Paho silently drops qos 0 messages while reconnecting
+	if p.client == nil || !p.client.IsConnectionOpen() {
+		return fmt.Errorf("unable to publish message on topic %s: %w", topic, MQTT.ErrNotConnected)
+	}
 	tokenResp := p.client.Publish(topic, byte(p.Oos), p.Retain, payload)
+	if !tokenResp.WaitTimeout(timeoutOrDefault(p.Timeout)) {
+		return fmt.Errorf("unable to publish message on topic %s: timeout", topic)
+	}
 	if tokenResp.Error() != nil {
-		log.Fatalf("%+v\n", tokenResp.Error())
+		return fmt.Errorf("unable to publish message on topic %s: %w", topic, tokenResp.Error())
 	}
+	return nil
 }
 
-// Close connection to broker
+// IsConnected return true if connection to broker is up
+func (p *PahoMqttPublisher) IsConnected() bool {
+	return p.client != nil && p.client.IsConnectionOpen()
+}
+
+// OnConnect register handler called after each (re)connection to broker
+func (p *PahoMqttPublisher) OnConnect(handler func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.onConnect = append(p.onConnect, handler)
+}
+
+// Close publish offline availability and disconnect from broker, connection attempts are stopped
 func (p *PahoMqttPublisher) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	if p.client == nil {
+		// Never connected
+		return
+	}
+	if p.Availability != nil && p.client.IsConnectionOpen() {
+		if err := p.publishRetained(p.client, p.Availability.Topic, p.Availability.closed()); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
 	p.client.Disconnect(500)
 }
 
+func (p *PahoMqttPublisher) publishRetained(client MQTT.Client, topic string, payload string) error {
+	token := client.Publish(topic, byte(p.Oos), true, payload)
+	if !token.WaitTimeout(timeoutOrDefault(p.Timeout)) {
+		return fmt.Errorf("unable to publish message on topic %s: timeout", topic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("unable to publish message on topic %s: %w", topic, token.Error())
+	}
+	return nil
+}
+
+// Subscribe to topic, subscription is restored after reconnection
+func (p *PahoMqttPublisher) Subscribe(topic string, handler MessageHandler) error {
+	p.mutex.Lock()
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[string]MessageHandler)
+	}
+	p.subscriptions[topic] = handler
+	p.mutex.Unlock()
+
+	if p.client == nil {
+		// Subscribed on connection
+		return nil
+	}
+	return p.subscribe(p.client, topic, handler)
+}
+
+func (p *PahoMqttPublisher) subscribe(client MQTT.Client, topic string, handler MessageHandler) error {
+	token := client.Subscribe(topic, byte(p.Oos), func(client MQTT.Client, msg MQTT.Message) {
+		handler(&Message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	if !token.WaitTimeout(timeoutOrDefault(p.Timeout)) {
+		return fmt.Errorf("unable to subscribe to topic %s: timeout", topic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %w", topic, token.Error())
+	}
+	return nil
+}
+
+func (p *PahoMqttPublisher) onConnected(client MQTT.Client) {
+	if p.Availability != nil {
+		if err := p.publishRetained(client, p.Availability.Topic, p.Availability.online()); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	// Subscriptions are restored without holding the mutex, a stalled broker must not block Subscribe
+	p.mutex.Lock()
+	subscriptions := make(map[string]MessageHandler, len(p.subscriptions))
+	for topic, handler := range p.subscriptions {
+		subscriptions[topic] = handler
+	}
+	handlers := p.onConnect
+	p.mutex.Unlock()
+
+	for topic, handler := range subscriptions {
+		if err := p.subscribe(client, topic, handler); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// Connect to broker, connection is retried in background when broker is unreachable.
+// Messages can't be published until connected, they are kept by a QueuedPublisher.
 func (p *PahoMqttPublisher) Connect() {
-	if p.client != nil && p.client.IsConnected() {
+	if p.client != nil {
 		return
 	}
-	//create a ClientOptions struct setting the broker address, clientid, turn
-	//off trace output and set the default message handler
+	//create a ClientOptions struct setting the broker address and clientid,
+	//messages are received by subscription handlers
 	opts := MQTT.NewClientOptions().AddBroker(p.Uri)
 	opts.SetUsername(p.Username)
 	opts.SetPassword(p.Password)
+	if p.Credentials != nil {
+		opts.SetCredentialsProvider(func() (string, string) {
+			return p.credentials()
+		})
+	}
 	opts.SetClientID(p.ClientId)
 	opts.SetAutoReconnect(true)
-	opts.SetDefaultPublishHandler(
-		//define a function for the default message handler
-		func(client MQTT.Client, msg MQTT.Message) {
-			fmt.Printf("TOPIC: %s\n", msg.Topic())
-			fmt.Printf("MSG: %s\n", msg.Payload())
-		})
-
+	opts.SetOnConnectHandler(p.onConnected)
+	if p.TLSConfig != nil {
+		opts.SetTLSConfig(p.TLSConfig)
+	}
+	if p.Availability != nil {
+		opts.SetWill(p.Availability.Topic, p.Availability.offline(), byte(p.Oos), true)
+	}
 	//create and start a client using the above ClientOptions
 	p.client = MQTT.NewClient(opts)
-	if token := p.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	if err := p.connect(); err != nil {
+		log.Printf("unable to connect to broker %s, retry in %v: %v\n", p.Uri, p.retryDelay(), err)
+		go p.retryConnect()
+	}
+}
+
+func (p *PahoMqttPublisher) connect() error {
+	token := p.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+// retryConnect connect to broker until it succeeds or publisher is closed, paho only reconnects lost connections
+func (p *PahoMqttPublisher) retryConnect() {
+	for {
+		time.Sleep(p.retryDelay())
+		if p.isClosed() {
+			return
+		}
+		err := p.connect()
+		if err == nil {
+			if p.isClosed() {
+				// Publisher closed while connecting
+				p.client.Disconnect(500)
+			}
+			return
+		}
+		log.Printf("unable to connect to broker %s, retry in %v: %v\n", p.Uri, p.retryDelay(), err)
+	}
+}
+
+func (p *PahoMqttPublisher) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *PahoMqttPublisher) retryDelay() time.Duration {
+	if p.RetryDelay <= 0 {
+		return DefaultConnectRetryDelay
+	}
+	return p.RetryDelay
+}
+
+// credentials return credentials of provider, configured ones if provider fails
+func (p *PahoMqttPublisher) credentials() (string, string) {
+	username, password, err := p.Credentials()
+	if err != nil {
+		log.Printf("unable to read broker credentials: %v\n", err)
+		return p.Username, p.Password
+	}
+	return username, password
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return 10 * time.Second
 	}
+	return timeout
 }
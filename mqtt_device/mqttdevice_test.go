@@ -79,4 +79,38 @@ func TestIntegration(t *testing.T) {
 		}
 
 	})
+	t.Run("Subscribe", func(t *testing.T) {
+		p := PahoMqttPublisher{Uri: mqttUri, ClientId: "TestMqttSubscribe", Username: "guest", Password: "guest"}
+		p.Connect()
+		defer p.Close()
+
+		c := make(chan string)
+		err := p.Subscribe("test/subscribe", func(msg *Message) {
+			c <- string(msg.Payload)
+		})
+		if err != nil {
+			t.Fatalf("unable to subscribe: %v", err)
+		}
+
+		p.Publish("test/subscribe", "Test5678")
+		result := <-c
+		if result != "Test5678" {
+			t.Fatalf("bad message: %v\n", result)
+		}
+	})
+}
+
+func TestPahoMqttPublisher_NotConnected(t *testing.T) {
+	p := PahoMqttPublisher{Uri: "tcp://localhost:1883", ClientId: "test"}
+
+	if err := p.Publish("topic", "payload"); err == nil {
+		t.Error("expected error on publish without connection")
+	}
+	if err := p.Subscribe("topic", func(*Message) {}); err != nil {
+		t.Errorf("subscription must be kept until connection: %v", err)
+	}
+	p.Close()
+	if p.IsConnected() {
+		t.Error("publisher must not be connected")
+	}
 }
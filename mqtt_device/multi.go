@@ -0,0 +1,308 @@
+package mqttdevice
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConnectRetryDelay is the delay between two connection attempts to an unreachable broker
+const DefaultConnectRetryDelay = 30 * time.Second
+
+// DefaultBrokerQueueSize is the number of messages waiting to be published on a broker, new messages are dropped when full
+const DefaultBrokerQueueSize = 100
+
+// Broker is a publisher of MultiPublisher with the prefix added to its topics
+type Broker struct {
+	Name      string
+	Publisher Publisher
+	// Prefix added to published and subscribed topics, separated by '/', empty to keep topics
+	TopicPrefix string
+
+	mutex     sync.Mutex
+	connected bool
+	closed    bool
+	// Subscriptions done once broker is connected
+	pending map[string]MessageHandler
+	// Messages published in order by the broker goroutine, closed when publisher is closed
+	queue chan *brokerMessage
+	// Closed when queued messages are published after close
+	done chan struct{}
+}
+
+type brokerMessage struct {
+	topic      string
+	payload    interface{}
+	properties *Properties
+}
+
+func (b *Broker) topic(topic string) string {
+	if b.TopicPrefix == "" {
+		return topic
+	}
+	return b.TopicPrefix + "/" + topic
+}
+
+func (b *Broker) isReady() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ready()
+}
+
+// ready return true if broker is connected, must be called with mutex held
+func (b *Broker) ready() bool {
+	if !b.connected {
+		return false
+	}
+	if checker, ok := b.Publisher.(ConnectionChecker); ok {
+		return checker.IsConnected()
+	}
+	return true
+}
+
+// send queue message for the broker goroutine, an error is returned if broker is not connected or its queue is full
+func (b *Broker) send(msg *brokerMessage) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.ready() {
+		return fmt.Errorf("unable to publish message on topic %s: broker %s not connected", b.topic(msg.topic), b.Name)
+	}
+	select {
+	case b.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("unable to publish message on topic %s: queue of broker %s full", b.topic(msg.topic), b.Name)
+	}
+}
+
+// run publish queued messages until queue is closed, a slow or hung broker only delays its own messages
+func (b *Broker) run(queue <-chan *brokerMessage, done chan<- struct{}) {
+	defer close(done)
+	for msg := range queue {
+		var err error
+		if pp, ok := b.Publisher.(PropertiesPublisher); ok {
+			err = pp.PublishWithProperties(b.topic(msg.topic), msg.payload, msg.properties)
+		} else {
+			err = b.Publisher.Publish(b.topic(msg.topic), msg.payload)
+		}
+		if err != nil {
+			log.Printf("%s: %v\n", b.Name, err)
+		}
+	}
+}
+
+// MultiPublisher forwards messages to several brokers. Brokers are connected and published to concurrently,
+// an unreachable broker doesn't block the other ones: its connection is retried in background and
+// messages are not sent to it until it is connected.
+type MultiPublisher struct {
+	Brokers []*Broker
+	// Delay between two connection attempts, DefaultConnectRetryDelay when 0
+	RetryDelay time.Duration
+}
+
+// NewMultiPublisher return publisher forwarding messages to brokers
+func NewMultiPublisher(brokers ...*Broker) *MultiPublisher {
+	return &MultiPublisher{Brokers: brokers}
+}
+
+// Connect start connection to each broker, it returns once a broker is connected or all first attempts failed
+func (m *MultiPublisher) Connect() {
+	attempts := make(chan bool, len(m.Brokers))
+	for _, b := range m.Brokers {
+		go m.connect(b, attempts)
+	}
+	for range m.Brokers {
+		if <-attempts {
+			return
+		}
+	}
+}
+
+// connect broker until it succeeds or publisher is closed, result of first attempt is sent to attempts
+func (m *MultiPublisher) connect(b *Broker, attempts chan<- bool) {
+	for {
+		err := tryConnect(b.Publisher)
+		b.mutex.Lock()
+		closed := b.closed
+		var pending map[string]MessageHandler
+		if err == nil && !closed {
+			b.connected = true
+			pending, b.pending = b.pending, nil
+			b.queue, b.done = make(chan *brokerMessage, DefaultBrokerQueueSize), make(chan struct{})
+			go b.run(b.queue, b.done)
+		}
+		b.mutex.Unlock()
+		if err == nil && closed {
+			// Publisher closed while connecting
+			b.Publisher.Close()
+		}
+		for topic, handler := range pending {
+			if err := b.subscribe(topic, handler); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}
+		if attempts != nil {
+			attempts <- err == nil
+			attempts = nil
+		}
+		if err == nil || closed {
+			return
+		}
+		log.Printf("unable to connect to broker %s, retry in %v: %v\n", b.Name, m.retryDelay(), err)
+		time.Sleep(m.retryDelay())
+	}
+}
+
+// tryConnect connect publisher, publishers panic on invalid configuration, or when broker is unreachable if they don't retry in background
+func tryConnect(p Publisher) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	p.Connect()
+	return nil
+}
+
+func (m *MultiPublisher) retryDelay() time.Duration {
+	if m.RetryDelay <= 0 {
+		return DefaultConnectRetryDelay
+	}
+	return m.RetryDelay
+}
+
+// Close publish queued messages then disconnect from connected brokers, and stop connection attempts
+func (m *MultiPublisher) Close() {
+	var wg sync.WaitGroup
+	for _, b := range m.Brokers {
+		b.mutex.Lock()
+		connected := b.connected
+		b.closed, b.connected = true, false
+		if connected {
+			close(b.queue)
+		}
+		b.mutex.Unlock()
+		if !connected {
+			continue
+		}
+		wg.Add(1)
+		go func(b *Broker) {
+			defer wg.Done()
+			<-b.done
+			b.Publisher.Close()
+		}(b)
+	}
+	wg.Wait()
+}
+
+// Publish message to all connected brokers
+func (m *MultiPublisher) Publish(topic string, payload interface{}) error {
+	return m.PublishWithProperties(topic, payload, nil)
+}
+
+// PublishWithProperties queue message for all connected brokers without waiting for its publication,
+// properties are ignored by brokers not supporting them. Each broker publishes its messages in order on its own goroutine,
+// publication failures are logged. An error is returned only if the message couldn't be queued for any broker.
+func (m *MultiPublisher) PublishWithProperties(topic string, payload interface{}, properties *Properties) error {
+	msg := brokerMessage{topic: topic, payload: payload, properties: properties}
+	var failures []string
+	for _, b := range m.Brokers {
+		if err := b.send(&msg); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", b.Name, err))
+		}
+	}
+	if len(failures) > 0 && len(failures) == len(m.Brokers) {
+		return fmt.Errorf("unable to publish message on any broker: %s", strings.Join(failures, ", "))
+	}
+	for _, failure := range failures {
+		log.Printf("%s\n", failure)
+	}
+	return nil
+}
+
+// Subscribe to topic on each broker supporting subscriptions, handler receives topics without broker prefix.
+// Subscriptions to brokers not connected yet are done on connection.
+func (m *MultiPublisher) Subscribe(topic string, handler MessageHandler) error {
+	subscribed := false
+	var errs []string
+	for _, b := range m.Brokers {
+		if _, ok := b.Publisher.(Subscriber); !ok {
+			continue
+		}
+		b.mutex.Lock()
+		connected := b.connected
+		if !connected {
+			if b.pending == nil {
+				b.pending = make(map[string]MessageHandler)
+			}
+			b.pending[topic] = handler
+		}
+		b.mutex.Unlock()
+		if connected {
+			if err := b.subscribe(topic, handler); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+		}
+		subscribed = true
+	}
+	if !subscribed {
+		if len(errs) == 0 {
+			return fmt.Errorf("no broker supports subscriptions")
+		}
+		return fmt.Errorf("unable to subscribe to topic %s: %s", topic, strings.Join(errs, ", "))
+	}
+	for _, err := range errs {
+		log.Printf("%s\n", err)
+	}
+	return nil
+}
+
+func (b *Broker) subscribe(topic string, handler MessageHandler) error {
+	if err := b.Publisher.(Subscriber).Subscribe(b.topic(topic), b.unprefixed(handler)); err != nil {
+		return fmt.Errorf("%s: %w", b.Name, err)
+	}
+	return nil
+}
+
+func (b *Broker) unprefixed(handler MessageHandler) MessageHandler {
+	if b.TopicPrefix == "" {
+		return handler
+	}
+	return func(msg *Message) {
+		unprefixed := *msg
+		unprefixed.Topic = strings.TrimPrefix(msg.Topic, b.TopicPrefix+"/")
+		handler(&unprefixed)
+	}
+}
+
+// OnConnect register handler on each broker notifying connections
+func (m *MultiPublisher) OnConnect(handler func()) {
+	for _, b := range m.Brokers {
+		if notifier, ok := b.Publisher.(ConnectionNotifier); ok {
+			notifier.OnConnect(handler)
+		}
+	}
+}
+
+// OnBrokerConnect register handler on each broker notifying connections, called with the name of the broker
+func (m *MultiPublisher) OnBrokerConnect(handler func(broker string)) {
+	for _, b := range m.Brokers {
+		if notifier, ok := b.Publisher.(ConnectionNotifier); ok {
+			name := b.Name
+			notifier.OnConnect(func() { handler(name) })
+		}
+	}
+}
+
+// IsConnected return true if at least one broker is connected
+func (m *MultiPublisher) IsConnected() bool {
+	for _, b := range m.Brokers {
+		if b.isReady() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package mqttdevice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakyBroker struct {
+	mutex       sync.Mutex
+	unreachable bool
+	published   []string
+	handlers    map[string]MessageHandler
+	// Publish waits on hung until it is closed when set
+	hung chan struct{}
+}
+
+func (f *flakyBroker) Connect() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.unreachable {
+		panic("connection refused")
+	}
+}
+
+func (f *flakyBroker) Close() {}
+
+func (f *flakyBroker) Publish(topic string, payload interface{}) error {
+	if f.hung != nil {
+		<-f.hung
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.published = append(f.published, fmt.Sprintf("%s=%v", topic, payload))
+	return nil
+}
+
+func (f *flakyBroker) Subscribe(topic string, handler MessageHandler) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.handlers == nil {
+		f.handlers = make(map[string]MessageHandler)
+	}
+	f.handlers[topic] = handler
+	return nil
+}
+
+func (f *flakyBroker) setReachable() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.unreachable = false
+}
+
+// waitPublished wait for messages to be published by broker goroutine, return published messages
+func (f *flakyBroker) waitPublished(count int) string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mutex.Lock()
+		published := fmt.Sprint(f.published)
+		done := len(f.published) >= count
+		f.mutex.Unlock()
+		if done || time.Now().After(deadline) {
+			return published
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *flakyBroker) handler(topic string) MessageHandler {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.handlers[topic]
+}
+
+func TestMultiPublisher(t *testing.T) {
+	local := flakyBroker{}
+	remote := flakyBroker{unreachable: true}
+	m := NewMultiPublisher(
+		&Broker{Name: "local", Publisher: &local},
+		&Broker{Name: "remote", Publisher: &remote, TopicPrefix: "building"},
+	)
+	m.RetryDelay = time.Millisecond
+	m.Connect()
+	defer m.Close()
+
+	if err := m.Publish("warmup/room/temperature", "19.5"); err != nil {
+		t.Errorf("an unreachable broker must not fail publication: %v", err)
+	}
+	if published := local.waitPublished(1); published != "[warmup/room/temperature=19.5]" {
+		t.Errorf("message must be published on connected broker, actual: %v", published)
+	}
+
+	var received []string
+	if err := m.Subscribe("warmup/room/mode/set", func(msg *Message) { received = append(received, msg.Topic) }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	remote.setReachable()
+	deadline := time.Now().Add(time.Second)
+	for remote.handler("building/warmup/room/mode/set") == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription must be done once broker is connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	remote.handler("building/warmup/room/mode/set")(&Message{Topic: "building/warmup/room/mode/set"})
+	if fmt.Sprint(received) != "[warmup/room/mode/set]" {
+		t.Errorf("topic prefix must be removed from received messages, actual: %v", received)
+	}
+
+	if err := m.Publish("warmup/room/temperature", "20"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if published := remote.waitPublished(1); published != "[building/warmup/room/temperature=20]" {
+		t.Errorf("message must be published with broker topic prefix, actual: %v", published)
+	}
+}
+
+func TestMultiPublisher_HungBroker(t *testing.T) {
+	local := flakyBroker{}
+	hung := flakyBroker{hung: make(chan struct{})}
+	m := NewMultiPublisher(&Broker{Name: "local", Publisher: &local}, &Broker{Name: "hung", Publisher: &hung})
+	m.Connect()
+	defer m.Close()
+	defer close(hung.hung)
+	for !m.Brokers[0].isReady() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.Publish("warmup/room/temperature", i); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if published := local.waitPublished(3); published != "[warmup/room/temperature=0 warmup/room/temperature=1 warmup/room/temperature=2]" {
+		t.Errorf("a hung broker must not delay other brokers, actual: %v", published)
+	}
+}
+
+func TestMultiPublisher_CloseFlushesQueue(t *testing.T) {
+	local := flakyBroker{}
+	m := NewMultiPublisher(&Broker{Name: "local", Publisher: &local})
+	m.Connect()
+	for i := 0; i < 3; i++ {
+		if err := m.Publish("warmup/room/temperature", i); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	m.Close()
+	if len(local.published) != 3 {
+		t.Errorf("queued messages must be published on close, actual: %v", local.published)
+	}
+	if err := m.Publish("warmup/room/temperature", 3); err == nil {
+		t.Errorf("error expected when publisher is closed")
+	}
+}
+
+func TestMultiPublisher_AllBrokersDown(t *testing.T) {
+	m := NewMultiPublisher(&Broker{Name: "local", Publisher: &flakyBroker{unreachable: true}})
+	m.RetryDelay = time.Hour
+	m.Connect()
+	defer m.Close()
+
+	if err := m.Publish("warmup/room/temperature", "19.5"); err == nil {
+		t.Errorf("error expected when no broker is connected")
+	}
+	if m.IsConnected() {
+		t.Errorf("not connected expected")
+	}
+}
+
+type notifyingBroker struct {
+	flakyBroker
+	handlers []func()
+}
+
+func (n *notifyingBroker) OnConnect(handler func()) {
+	n.handlers = append(n.handlers, handler)
+}
+
+func TestMultiPublisher_OnBrokerConnect(t *testing.T) {
+	local, remote := &notifyingBroker{}, &notifyingBroker{}
+	m := NewMultiPublisher(&Broker{Name: "local", Publisher: local}, &Broker{Name: "remote", Publisher: remote})
+	var connected []string
+	m.OnBrokerConnect(func(broker string) { connected = append(connected, broker) })
+	remote.handlers[0]()
+	local.handlers[0]()
+	if fmt.Sprint(connected) != "[remote local]" {
+		t.Errorf("connections must be notified with broker name, actual: %v", connected)
+	}
+}
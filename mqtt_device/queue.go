@@ -0,0 +1,234 @@
+package mqttdevice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultQueueSize = 1000
+
+// QueuedPublisher stores messages in a bounded queue while broker is unreachable and publishes them
+// in order once the connection is back. Queue is persisted to a file to survive restarts when File is set.
+type QueuedPublisher struct {
+	Publisher Publisher
+	// Maximum number of queued messages, oldest messages are dropped when queue is full
+	MaxSize int
+	// File used to persist queue, empty to keep queue in memory only
+	File string
+
+	mutex sync.Mutex
+	queue []queuedMessage
+	now   func() time.Time
+}
+
+type queuedMessage struct {
+	Topic      string      `json:"topic"`
+	Payload    string      `json:"payload"`
+	Properties *Properties `json:"properties,omitempty"`
+	QueuedAt   time.Time   `json:"queued_at"`
+}
+
+// NewQueuedPublisher wrap publisher with a queue restored from file if it exists
+func NewQueuedPublisher(p Publisher, maxSize int, file string) (*QueuedPublisher, error) {
+	q := QueuedPublisher{Publisher: p, MaxSize: maxSize, File: file}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (q *QueuedPublisher) Connect() {
+	if notifier, ok := q.Publisher.(ConnectionNotifier); ok {
+		notifier.OnConnect(func() {
+			if err := q.Drain(); err != nil {
+				log.Printf("unable to publish queued messages: %v\n", err)
+			}
+		})
+	}
+	q.Publisher.Connect()
+}
+
+func (q *QueuedPublisher) Close() {
+	q.Publisher.Close()
+}
+
+// Publish message, or queue it if it can't be published now
+func (q *QueuedPublisher) Publish(topic string, payload interface{}) error {
+	return q.PublishWithProperties(topic, payload, nil)
+}
+
+// PublishWithProperties publish message with properties, or queue it if it can't be published now
+func (q *QueuedPublisher) PublishWithProperties(topic string, payload interface{}, properties *Properties) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	msg := queuedMessage{Topic: topic, Payload: string(toBytes(payload)), Properties: properties, QueuedAt: q.timestamp()}
+	// Keep order of messages, new message can't be published before queued ones
+	if err := q.drain(); err == nil {
+		if err := q.publish(&msg); err == nil {
+			return nil
+		}
+	}
+	return q.enqueue(msg)
+}
+
+// Subscribe to topic with the wrapped publisher
+func (q *QueuedPublisher) Subscribe(topic string, handler MessageHandler) error {
+	subscriber, ok := q.Publisher.(Subscriber)
+	if !ok {
+		return fmt.Errorf("publisher doesn't support subscriptions")
+	}
+	return subscriber.Subscribe(topic, handler)
+}
+
+// OnConnect register handler on the wrapped publisher if it notifies connections
+func (q *QueuedPublisher) OnConnect(handler func()) {
+	if notifier, ok := q.Publisher.(ConnectionNotifier); ok {
+		notifier.OnConnect(handler)
+	}
+}
+
+// OnBrokerConnect register handler on the wrapped publisher, a publisher connected to a single broker notifies it as ""
+func (q *QueuedPublisher) OnBrokerConnect(handler func(broker string)) {
+	if notifier, ok := q.Publisher.(BrokerConnectionNotifier); ok {
+		notifier.OnBrokerConnect(handler)
+	} else {
+		q.OnConnect(func() { handler("") })
+	}
+}
+
+// IsConnected return connection state of the wrapped publisher, true if it can't report it
+func (q *QueuedPublisher) IsConnected() bool {
+	if checker, ok := q.Publisher.(ConnectionChecker); ok {
+		return checker.IsConnected()
+	}
+	return true
+}
+
+// Len return number of queued messages
+func (q *QueuedPublisher) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.queue)
+}
+
+// Drain publish queued messages in order, stop on first failure
+func (q *QueuedPublisher) Drain() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.drain()
+}
+
+func (q *QueuedPublisher) drain() error {
+	if len(q.queue) == 0 {
+		return nil
+	}
+	sent := 0
+	var err error
+	for sent < len(q.queue) {
+		if err = q.publish(&q.queue[sent]); err != nil {
+			break
+		}
+		sent++
+	}
+	if sent > 0 {
+		q.queue = q.queue[sent:]
+		if err := q.save(); err != nil {
+			log.Printf("%v\n", err)
+		}
+		log.Printf("%d queued messages published, %d remaining\n", sent, len(q.queue))
+	}
+	return err
+}
+
+func (q *QueuedPublisher) publish(msg *queuedMessage) error {
+	properties := msg.Properties
+	if properties != nil && properties.MessageExpiry > 0 {
+		// Message expiry starts when the message is queued
+		remaining := properties.MessageExpiry - q.timestamp().Sub(msg.QueuedAt)
+		if remaining <= 0 {
+			return nil
+		}
+		copied := *properties
+		copied.MessageExpiry = remaining
+		properties = &copied
+	}
+	if p, ok := q.Publisher.(PropertiesPublisher); ok && properties != nil {
+		return p.PublishWithProperties(msg.Topic, msg.Payload, properties)
+	}
+	return q.Publisher.Publish(msg.Topic, msg.Payload)
+}
+
+func (q *QueuedPublisher) enqueue(msg queuedMessage) error {
+	maxSize := q.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultQueueSize
+	}
+	if len(q.queue) >= maxSize {
+		dropped := len(q.queue) - maxSize + 1
+		log.Printf("publication queue full, %d oldest messages dropped\n", dropped)
+		q.queue = q.queue[dropped:]
+	}
+	q.queue = append(q.queue, msg)
+	return q.save()
+}
+
+func (q *QueuedPublisher) load() error {
+	if q.File == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(q.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read queue file %s: %w", q.File, err)
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(content, &q.queue); err != nil {
+		return fmt.Errorf("invalid queue file %s: %w", q.File, err)
+	}
+	return nil
+}
+
+// save write queue to a temporary file renamed to queue file, to never leave a truncated queue
+func (q *QueuedPublisher) save() error {
+	if q.File == "" {
+		return nil
+	}
+	content, err := json.Marshal(q.queue)
+	if err != nil {
+		return fmt.Errorf("unable to marshal queue: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(q.File), filepath.Base(q.File)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to write queue file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write queue file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write queue file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.File); err != nil {
+		return fmt.Errorf("unable to write queue file: %w", err)
+	}
+	return nil
+}
+
+func (q *QueuedPublisher) timestamp() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
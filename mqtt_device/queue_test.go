@@ -0,0 +1,147 @@
+package mqttdevice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeBroker struct {
+	down      bool
+	published []string
+	onConnect func()
+}
+
+func (f *fakeBroker) Connect() {}
+
+func (f *fakeBroker) Close() {}
+
+func (f *fakeBroker) Publish(topic string, payload interface{}) error {
+	if f.down {
+		return fmt.Errorf("not connected")
+	}
+	f.published = append(f.published, fmt.Sprintf("%s=%v", topic, payload))
+	return nil
+}
+
+func (f *fakeBroker) OnConnect(handler func()) {
+	f.onConnect = handler
+}
+
+func TestQueuedPublisher(t *testing.T) {
+	broker := fakeBroker{}
+	q, err := NewQueuedPublisher(&broker, 2, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q.Connect()
+
+	if err := q.Publish("topic/1", "a"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	broker.down = true
+	for _, payload := range []string{"b", "c", "d"} {
+		if err := q.Publish("topic/1", payload); err != nil {
+			t.Errorf("message must be queued without error: %v", err)
+		}
+	}
+	if q.Len() != 2 {
+		t.Errorf("queue must be bounded to 2 messages, actual: %d", q.Len())
+	}
+
+	broker.down = false
+	broker.onConnect()
+	expected := []string{"topic/1=a", "topic/1=c", "topic/1=d"}
+	if fmt.Sprint(broker.published) != fmt.Sprint(expected) {
+		t.Errorf("bad published messages, expected: %v, actual: %v", expected, broker.published)
+	}
+	if q.Len() != 0 {
+		t.Errorf("empty queue expected after reconnection, actual: %d", q.Len())
+	}
+}
+
+func TestQueuedPublisher_KeepOrder(t *testing.T) {
+	broker := fakeBroker{down: true}
+	q, _ := NewQueuedPublisher(&broker, 10, "")
+	_ = q.Publish("topic/1", "a")
+
+	broker.down = false
+	_ = q.Publish("topic/1", "b")
+	expected := []string{"topic/1=a", "topic/1=b"}
+	if fmt.Sprint(broker.published) != fmt.Sprint(expected) {
+		t.Errorf("queued messages must be published first, expected: %v, actual: %v", expected, broker.published)
+	}
+}
+
+func TestQueuedPublisher_Expiry(t *testing.T) {
+	broker := fakeBroker{down: true}
+	now := time.Date(2019, 11, 2, 10, 0, 0, 0, time.UTC)
+	q := QueuedPublisher{Publisher: &broker, now: func() time.Time { return now }}
+	_ = q.PublishWithProperties("topic/1", "a", &Properties{MessageExpiry: time.Minute})
+	_ = q.PublishWithProperties("topic/1", "b", &Properties{MessageExpiry: time.Hour})
+
+	now = now.Add(10 * time.Minute)
+	broker.down = false
+	if err := q.Drain(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []string{"topic/1=b"}
+	if fmt.Sprint(broker.published) != fmt.Sprint(expected) {
+		t.Errorf("expired message must be dropped, expected: %v, actual: %v", expected, broker.published)
+	}
+}
+
+func TestQueuedPublisher_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queue.json")
+
+	broker := fakeBroker{down: true}
+	q, err := NewQueuedPublisher(&broker, 10, file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = q.Publish("topic/1", "a")
+	_ = q.Publish("topic/2", "b")
+
+	broker = fakeBroker{}
+	restored, err := NewQueuedPublisher(&broker, 10, file)
+	if err != nil {
+		t.Fatalf("unable to restore queue: %v", err)
+	}
+	if restored.Len() != 2 {
+		t.Fatalf("2 messages expected in restored queue, actual: %d", restored.Len())
+	}
+	if err := restored.Drain(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []string{"topic/1=a", "topic/2=b"}
+	if fmt.Sprint(broker.published) != fmt.Sprint(expected) {
+		t.Errorf("bad published messages, expected: %v, actual: %v", expected, broker.published)
+	}
+}
+
+func TestQueuedPublisher_BrokerDownAtStartup(t *testing.T) {
+	for _, p := range []Publisher{
+		&PahoMqttPublisher{Uri: "tcp://127.0.0.1:1", ClientId: "test", RetryDelay: time.Hour},
+		&Paho5MqttPublisher{Uri: "tcp://127.0.0.1:1", ClientId: "test", Timeout: 100 * time.Millisecond},
+	} {
+		q := QueuedPublisher{Publisher: p, MaxSize: 10}
+		// Connection is retried in background instead of panicking
+		q.Connect()
+		if err := q.Publish("room/status", "ok"); err != nil {
+			t.Errorf("%T: message must be queued, actual: %v", p, err)
+		}
+		if q.Len() != 1 {
+			t.Errorf("%T: 1 queued message expected, actual: %d", p, q.Len())
+		}
+		q.Close()
+	}
+}
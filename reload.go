@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultConfigCheckInterval is the interval between two checks of configuration file modification
+const DefaultConfigCheckInterval = 10 * time.Second
+
+// Settings are the monitor options that can be changed without reconnecting to broker
+type Settings struct {
+	Topics        *TopicLayout
+	Payload       PayloadMode
+	Schedule      *PollSchedule
+	Changes       *ChangeFilter
+	Commands      bool
+	MessageExpiry time.Duration
+	Backoff       Backoff
+	StaleAfter    int
+	Alerts        *Alerts
+}
+
+// Reconfigure replace monitor settings, they are applied by the poll loop that polls immediately
+func (m *Monitor) Reconfigure(s *Settings) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pending = s
+	if m.reconfigured == nil {
+		m.reconfigured = make(chan struct{}, 1)
+	}
+	select {
+	case m.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Monitor) reconfiguredChan() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.reconfigured == nil {
+		m.reconfigured = make(chan struct{}, 1)
+	}
+	return m.reconfigured
+}
+
+// applySettings apply pending settings, must be called from the poll loop
+func (m *Monitor) applySettings() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.pending
+	if s == nil {
+		return
+	}
+	m.pending = nil
+	m.Topics = s.Topics
+	m.Payload = s.Payload
+	m.Schedule = s.Schedule
+	m.IdleTime = s.Schedule.Interval
+	m.Commands = s.Commands
+	m.MessageExpiry = s.MessageExpiry
+	m.Backoff = s.Backoff
+	m.StaleAfter = s.StaleAfter
+	if s.Changes != nil && m.Changes != nil {
+		// Keep last published values to not republish everything
+		m.Changes.Deadband = s.Changes.Deadband
+		m.Changes.Heartbeat = s.Changes.Heartbeat
+	} else {
+		m.Changes = s.Changes
+	}
+	if s.Alerts != nil && m.Alerts != nil {
+		// Keep raised alerts to not raise them again
+		m.Alerts.SetRules(s.Alerts.Rules)
+	} else {
+		m.Alerts = s.Alerts
+	}
+	log.Printf("configuration applied\n")
+}
+
+// topics return topic layout in use, read under mutex as commands are handled while settings are applied
+func (m *Monitor) topics() *TopicLayout {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Topics
+}
+
+// payload return payload mode in use, read under mutex as commands are handled while settings are applied
+func (m *Monitor) payload() PayloadMode {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Payload
+}
+
+// messageExpiry return expiry of room values in use, read under mutex as commands are handled while settings are applied
+func (m *Monitor) messageExpiry() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.MessageExpiry
+}
+
+// WatchConfig call reload when configuration file is modified, until ctx is cancelled
+func WatchConfig(ctx context.Context, file string, interval time.Duration, reload func()) {
+	modTime := func() time.Time {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current := modTime(); !current.Equal(last) {
+				last = current
+				log.Printf("configuration file %s modified\n", file)
+				reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPollInterval     = 3 * time.Minute
+	DefaultFastPollInterval = 20 * time.Second
+	DefaultFastPollWindow   = 2 * time.Minute
+)
+
+// PollSchedule computes the delay between two successful polls
+type PollSchedule struct {
+	// Interval used outside of profiles
+	Interval time.Duration
+	// Interval used during FastWindow after a command, to confirm quickly the new state, 0 to disable
+	FastInterval time.Duration
+	FastWindow   time.Duration
+	// Intervals by time of day, the first matching profile is used
+	Profiles []IntervalProfile
+}
+
+// IntervalProfile is a poll interval used between two times of day, in local time.
+// Profile wraps around midnight when Start is after End.
+type IntervalProfile struct {
+	// Offsets from midnight
+	Start    time.Duration
+	End      time.Duration
+	Interval time.Duration
+}
+
+func (p IntervalProfile) contains(now time.Time) bool {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if p.Start <= p.End {
+		return offset >= p.Start && offset < p.End
+	}
+	return offset >= p.Start || offset < p.End
+}
+
+// Next return delay before next poll, lastCommand is the time of the last applied command
+func (s *PollSchedule) Next(now time.Time, lastCommand time.Time) time.Duration {
+	interval := s.IntervalAt(now)
+	if s.FastInterval > 0 && s.FastInterval < interval && !lastCommand.IsZero() && now.Sub(lastCommand) < s.FastWindow {
+		return s.FastInterval
+	}
+	return interval
+}
+
+// IntervalAt return regular poll interval at time of day of now
+func (s *PollSchedule) IntervalAt(now time.Time) time.Duration {
+	for _, p := range s.Profiles {
+		if p.contains(now) {
+			return p.Interval
+		}
+	}
+	return s.Interval
+}
+
+// ParseIntervalProfiles parse profiles with format '<HH:MM>-<HH:MM>=<interval>,...', ex '22:00-06:00=10m'
+func ParseIntervalProfiles(value string) ([]IntervalProfile, error) {
+	var profiles []IntervalProfile
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid interval profile '%s', expected '<HH:MM>-<HH:MM>=<interval>'", entry)
+		}
+		times := strings.SplitN(parts[0], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid interval profile '%s', expected '<HH:MM>-<HH:MM>=<interval>'", entry)
+		}
+		var profile IntervalProfile
+		var err error
+		if profile.Start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, fmt.Errorf("invalid interval profile '%s': %w", entry, err)
+		}
+		if profile.End, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, fmt.Errorf("invalid interval profile '%s': %w", entry, err)
+		}
+		if profile.Interval, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("invalid interval profile '%s': %w", entry, err)
+		}
+		if profile.Interval <= 0 {
+			return nil, fmt.Errorf("invalid interval profile '%s': interval must be positive", entry)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
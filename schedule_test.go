@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseIntervalProfiles(t *testing.T) {
+	profiles, err := ParseIntervalProfiles("22:00-06:30=10m, 09:00-17:00=5m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("2 profiles expected, actual: %v", profiles)
+	}
+	expected := IntervalProfile{Start: 22 * time.Hour, End: 6*time.Hour + 30*time.Minute, Interval: 10 * time.Minute}
+	if profiles[0] != expected {
+		t.Errorf("bad profile, expected: %+v, actual: %+v", expected, profiles[0])
+	}
+
+	for _, value := range []string{"22:00=10m", "22:00-06:00", "25:00-06:00=10m", "22:00-06:00=fast", "22:00-06:00=0s"} {
+		if _, err := ParseIntervalProfiles(value); err == nil {
+			t.Errorf("error expected for profiles '%s'", value)
+		}
+	}
+}
+
+func TestPollSchedule_Next(t *testing.T) {
+	profiles, _ := ParseIntervalProfiles("22:00-06:00=10m")
+	s := PollSchedule{Interval: 3 * time.Minute, FastInterval: 20 * time.Second, FastWindow: 2 * time.Minute, Profiles: profiles}
+	day := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	night := time.Date(2019, 11, 2, 2, 0, 0, 0, time.UTC)
+
+	if next := s.Next(day, time.Time{}); next != 3*time.Minute {
+		t.Errorf("base interval expected, actual: %v", next)
+	}
+	if next := s.Next(night, time.Time{}); next != 10*time.Minute {
+		t.Errorf("night profile interval expected, actual: %v", next)
+	}
+	if next := s.Next(day.Add(12*time.Hour+30*time.Minute), time.Time{}); next != 10*time.Minute {
+		t.Errorf("night profile interval expected before midnight, actual: %v", next)
+	}
+	if next := s.Next(day, day.Add(-time.Minute)); next != 20*time.Second {
+		t.Errorf("fast interval expected after command, actual: %v", next)
+	}
+	if next := s.Next(day, day.Add(-5*time.Minute)); next != 3*time.Minute {
+		t.Errorf("base interval expected after fast window, actual: %v", next)
+	}
+}
+
+func TestMonitor_WaitAnticipatedByCommand(t *testing.T) {
+	m := Monitor{Schedule: &PollSchedule{Interval: time.Hour, FastInterval: time.Millisecond, FastWindow: time.Minute}}
+
+	done := make(chan bool)
+	go func() { done <- m.wait(context.Background(), time.Hour) }()
+	m.recordCommand()
+	select {
+	case polled := <-done:
+		if !polled {
+			t.Errorf("next poll expected")
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("next poll must be anticipated after a command")
+	}
+}
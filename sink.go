@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+// Events written to sinks
+const (
+	EventTargetTemperature = "target_temperature"
+	EventRunMode           = "run_mode"
+	// Room appeared in or disappeared from poll results
+	EventReachability = "reachability"
+	// First failure of poller after a successful poll
+	EventPollFailed = "poll_failed"
+	// Successful poll after failures
+	EventPollRecovered = "poll_recovered"
+	// Alert of room raised or cleared
+	EventAlert = "alert"
+)
+
+// Event is a room change or a poll event, it is the json body sent to webhooks and the data of body templates
+type Event struct {
+	Event   string `json:"event"`
+	Account string `json:"account"`
+	// Room of room events, its last known values for unreachable rooms
+	Room *RoomState `json:"room,omitempty"`
+	// Previous and new value of changed room value, reachable boolean for reachability events
+	Previous interface{} `json:"previous,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	// Poll error of poll_failed events
+	Error string `json:"error,omitempty"`
+	// Raised or cleared alert of alert events
+	Alert     *Alert    `json:"alert,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RoomSnapshot is the result of a successful poll of an account
+type RoomSnapshot struct {
+	Account string
+	Rooms   []warmup4ie.Room
+	// Rooms of previous poll by id, nil on first poll
+	Previous  map[int]warmup4ie.Room
+	Timestamp time.Time
+}
+
+// Sink is an output of monitors receiving the rooms of each poll, and room changes and poll events.
+// Sinks handle their own errors, an error returned by a write is logged and counted without
+// affecting the other sinks nor the success of the poll.
+type Sink interface {
+	// Name of the sink in logs and metrics
+	Name() string
+	WriteRooms(snapshot *RoomSnapshot) error
+	WriteEvent(event *Event) error
+}
+
+// RunSinks run background delivery of sinks until ctx is cancelled, return functions flushing and closing sinks
+func RunSinks(ctx context.Context, sinks []Sink) []func() {
+	var closers []func()
+	for _, sink := range sinks {
+		if runner, ok := sink.(interface{ Run(ctx context.Context) }); ok {
+			go runner.Run(ctx)
+		}
+		if closer, ok := sink.(interface{ Close() }); ok {
+			closers = append(closers, closer.Close)
+		}
+	}
+	return closers
+}
+
+// mqttSink publishes rooms of monitor to its broker with the payload mode of the monitor
+type mqttSink struct {
+	m *Monitor
+}
+
+func (s mqttSink) Name() string {
+	return "mqtt"
+}
+
+// WriteRooms publish rooms, values not published are published again on next poll
+func (s mqttSink) WriteRooms(snapshot *RoomSnapshot) error {
+	return s.m.publishRooms(snapshot.Rooms, snapshot.Timestamp)
+}
+
+// WriteEvent publish alert events on alerts topic, poll status is published on status topic by the monitor
+func (s mqttSink) WriteEvent(event *Event) error {
+	if event.Event != EventAlert {
+		return nil
+	}
+	return s.m.publishAlert(event)
+}
+
+// sinks return the mqtt sink of monitor followed by its other sinks
+func (m *Monitor) sinks() []Sink {
+	return append([]Sink{mqttSink{m}}, m.Sinks...)
+}
+
+// writeRooms write snapshot to all sinks, errors are logged and counted as sink errors.
+// A broker outage doesn't fail the poll, warmup api is still polled at the regular interval.
+func (m *Monitor) writeRooms(snapshot *RoomSnapshot) {
+	for _, sink := range m.sinks() {
+		if err := sink.WriteRooms(snapshot); err != nil {
+			m.sinkError(sink, err)
+		}
+	}
+}
+
+// writeEvent write event to all sinks, errors are logged
+func (m *Monitor) writeEvent(event *Event) {
+	for _, sink := range m.sinks() {
+		if err := sink.WriteEvent(event); err != nil {
+			m.sinkError(sink, err)
+		}
+	}
+}
+
+func (m *Monitor) sinkError(sink Sink, err error) {
+	log.Printf("%sunable to write to %s: %v\n", m.logPrefix(), sink.Name(), err)
+	if m.Metrics != nil {
+		m.Metrics.SinkError(sink.Name())
+	}
+}
+
+// roomEvents return events of room changes between two polls, no event is returned on first poll
+func roomEvents(account string, previous map[int]warmup4ie.Room, rooms []warmup4ie.Room, timestamp time.Time) []*Event {
+	if previous == nil {
+		return nil
+	}
+	var events []*Event
+	event := func(name string, room *warmup4ie.Room, before interface{}, after interface{}) {
+		events = append(events, &Event{
+			Event:     name,
+			Account:   account,
+			Room:      NewRoomState(room, timestamp),
+			Previous:  before,
+			Value:     after,
+			Timestamp: timestamp.UTC(),
+		})
+	}
+	polled := make(map[int]bool, len(rooms))
+	for i := range rooms {
+		room := &rooms[i]
+		polled[room.Id] = true
+		before, ok := previous[room.Id]
+		if !ok {
+			event(EventReachability, room, false, true)
+			continue
+		}
+		if before.TargetTemp.GetValue() != room.TargetTemp.GetValue() {
+			event(EventTargetTemperature, room, before.TargetTemp.GetValue(), room.TargetTemp.GetValue())
+		}
+		if before.RunMode != room.RunMode {
+			event(EventRunMode, room, before.RunMode.String(), room.RunMode.String())
+		}
+	}
+	for id, before := range previous {
+		if !polled[id] {
+			room := before
+			event(EventReachability, &room, true, false)
+		}
+	}
+	return events
+}
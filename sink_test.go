@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type recordingSink struct {
+	name      string
+	err       error
+	snapshots []*RoomSnapshot
+	events    []*Event
+	closed    bool
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) WriteRooms(snapshot *RoomSnapshot) error {
+	s.snapshots = append(s.snapshots, snapshot)
+	return s.err
+}
+
+func (s *recordingSink) WriteEvent(event *Event) error {
+	s.events = append(s.events, event)
+	return s.err
+}
+
+func (s *recordingSink) Close() {
+	s.closed = true
+}
+
+func TestMonitor_Sinks(t *testing.T) {
+	m, _ := newCommandMonitor()
+	m.Name = "home"
+	m.Metrics = NewMetrics()
+	failing := &recordingSink{name: "failing", err: fmt.Errorf("unavailable")}
+	sink := &recordingSink{name: "sink"}
+	m.Sinks = []Sink{failing, sink}
+	if err := m.poll(); err != nil {
+		t.Fatalf("errors of sinks must not fail the poll: %v", err)
+	}
+	if len(sink.snapshots) != 1 || sink.snapshots[0].Account != "home" || len(sink.snapshots[0].Rooms) != 2 || sink.snapshots[0].Previous != nil {
+		t.Errorf("snapshot of first poll expected, actual: %+v", sink.snapshots)
+	}
+	if !strings.Contains(string(m.Metrics.Bytes()), `warmup4ie2mqtt_sink_errors_total{sink="failing"} 1`+"\n") {
+		t.Errorf("sink error must be counted:\n%s", m.Metrics.Bytes())
+	}
+
+	m.recordFailure(fmt.Errorf("timeout"), m.timestamp())
+	if len(sink.events) != 1 || sink.events[0].Event != EventPollFailed {
+		t.Errorf("poll failed event expected, actual: %+v", sink.events)
+	}
+
+	// Broker errors don't fail the poll, they are counted as sink errors
+	m.Publisher = failingPublisher{}
+	m.Commands = false
+	if err := m.poll(); err != nil {
+		t.Errorf("publish errors must not fail the poll: %v", err)
+	}
+	if !strings.Contains(string(m.Metrics.Bytes()), `warmup4ie2mqtt_sink_errors_total{sink="mqtt"} 1`+"\n") {
+		t.Errorf("broker error must be counted:\n%s", m.Metrics.Bytes())
+	}
+	if len(sink.snapshots) != 2 || sink.snapshots[1].Previous == nil {
+		t.Errorf("snapshot with previous rooms expected, actual: %+v", sink.snapshots)
+	}
+}
+
+func TestRunSinks(t *testing.T) {
+	sink := &recordingSink{name: "sink"}
+	closers := RunSinks(context.Background(), []Sink{NewMetrics(), sink})
+	if len(closers) != 1 {
+		t.Fatalf("only closable sinks expected, actual: %d", len(closers))
+	}
+	closers[0]()
+	if !sink.closed {
+		t.Errorf("sink must be closed")
+	}
+}
+
+func TestConfig_NewSinks(t *testing.T) {
+	config := DefaultConfig()
+	config.InfluxDB.Url = "http://influxdb:8086"
+	config.Webhooks = []WebhookConfig{{Url: "https://example.com/hook"}}
+	sinks, err := config.NewSinks(NewMetrics())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, sink := range sinks {
+		names = append(names, sink.Name())
+	}
+	if strings.Join(names, ",") != "metrics,influxdb,webhooks" {
+		t.Errorf("bad sinks: %v", names)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	DefaultSQLTable           = "room_history"
+	DefaultSQLFlushInterval   = time.Minute
+	DefaultSQLCleanupInterval = time.Hour
+)
+
+var sqlIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// sqlDialect holds the differences between supported databases
+type sqlDialect struct {
+	driver        string
+	timestampType string
+	placeholder   func(n int) string
+}
+
+var (
+	postgresDialect = sqlDialect{
+		driver:        "postgres",
+		timestampType: "TIMESTAMP WITH TIME ZONE",
+		placeholder:   func(n int) string { return "$" + strconv.Itoa(n) },
+	}
+	sqliteDialect = sqlDialect{
+		driver:        "sqlite3",
+		timestampType: "TIMESTAMP",
+		placeholder:   func(n int) string { return "?" },
+	}
+)
+
+// ParseDSN return dialect of database and data source name given to its driver.
+// Postgres DSN are postgres:// urls, SQLite ones are sqlite://<file> or file:<file> urls.
+func ParseDSN(dsn string) (sqlDialect, string, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgresDialect, dsn, nil
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return sqliteDialect, strings.TrimPrefix(dsn, "sqlite://"), nil
+	case strings.HasPrefix(dsn, "file:"):
+		return sqliteDialect, dsn, nil
+	default:
+		return sqlDialect{}, "", fmt.Errorf("unsupported dsn, expected postgres://, sqlite:// or file: url")
+	}
+}
+
+// SQLSink inserts one row per room and poll in a SQL database, table is created on first run.
+// Rows are inserted by batches, when BatchSize rows are pending or every FlushInterval,
+// rows older than Retention are deleted every CleanupInterval.
+type SQLSink struct {
+	Table         string
+	BatchSize     int
+	FlushInterval time.Duration
+	// Rows are kept forever when 0
+	Retention       time.Duration
+	CleanupInterval time.Duration
+	MaxPending      int
+	// Count background insert failures when set
+	Metrics *Metrics
+
+	db      *sql.DB
+	dialect sqlDialect
+
+	buffer batchBuffer
+}
+
+type roomRow struct {
+	timestamp  time.Time
+	account    string
+	locationId int
+	location   string
+	roomId     int
+	room       string
+	current    float32
+	target     float32
+	runMode    string
+}
+
+// OpenSQLSink connect to database of dsn and create table if it doesn't exist
+func OpenSQLSink(dsn string, table string) (*SQLSink, error) {
+	dialect, source, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if table == "" {
+		table = DefaultSQLTable
+	}
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %s", table)
+	}
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	s := SQLSink{Table: table, db: db, dialect: dialect}
+	if err := s.createSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *SQLSink) createSchema() error {
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	time %s NOT NULL,
+	account TEXT NOT NULL,
+	location_id INTEGER NOT NULL,
+	location TEXT NOT NULL,
+	room_id INTEGER NOT NULL,
+	room TEXT NOT NULL,
+	current_temperature REAL NOT NULL,
+	target_temperature REAL NOT NULL,
+	run_mode TEXT NOT NULL
+)`, s.Table, s.dialect.timestampType),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_time ON %s (time)", s.Table, s.Table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_room ON %s (room_id, time)", s.Table, s.Table),
+	}
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return fmt.Errorf("unable to create schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// Write add rows of rooms measured at timestamp to the next batch,
+// an error is returned when oldest rows are dropped because too many rows are pending
+func (s *SQLSink) Write(account string, rooms []warmup4ie.Room, timestamp time.Time) error {
+	rows := make([]interface{}, len(rooms))
+	for i := range rooms {
+		room := &rooms[i]
+		rows[i] = roomRow{
+			timestamp:  timestamp.UTC(),
+			account:    account,
+			locationId: room.LocationId,
+			location:   room.LocationName,
+			roomId:     room.Id,
+			room:       room.Name,
+			current:    room.CurrentTemp.GetValue(),
+			target:     room.TargetTemp.GetValue(),
+			runMode:    room.RunMode.String(),
+		}
+	}
+	if dropped := s.buffer.add(rows, s.BatchSize, s.MaxPending); dropped > 0 {
+		return fmt.Errorf("%d rows dropped, too many pending rows", dropped)
+	}
+	return nil
+}
+
+func (s *SQLSink) Name() string {
+	return "sql"
+}
+
+// WriteRooms add rows of snapshot rooms to the next batch, failed batches are retried in background
+// and their failures counted in Metrics
+func (s *SQLSink) WriteRooms(snapshot *RoomSnapshot) error {
+	return s.Write(snapshot.Account, snapshot.Rooms, snapshot.Timestamp)
+}
+
+// WriteEvent does nothing, only room values are written
+func (s *SQLSink) WriteEvent(event *Event) error {
+	return nil
+}
+
+// Run insert pending rows by batches and delete old rows until ctx is cancelled, remaining rows are inserted by Close
+func (s *SQLSink) Run(ctx context.Context) {
+	flush := time.NewTicker(s.flushInterval())
+	defer flush.Stop()
+	var cleanup <-chan time.Time
+	if s.Retention > 0 {
+		ticker := time.NewTicker(s.cleanupInterval())
+		defer ticker.Stop()
+		cleanup = ticker.C
+		s.logCleanup(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cleanup:
+			s.logCleanup(ctx)
+			continue
+		case <-flush.C:
+		case <-s.buffer.fullChan():
+		}
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("sql: %v\n", err)
+			s.sinkError()
+		}
+	}
+}
+
+// Close insert pending rows and close database
+func (s *SQLSink) Close() {
+	if err := s.Flush(context.Background()); err != nil {
+		log.Printf("sql: pending rows not inserted: %v\n", err)
+		s.sinkError()
+	}
+	if err := s.db.Close(); err != nil {
+		log.Printf("sql: %v\n", err)
+	}
+}
+
+// Flush insert pending rows by batches, failed batch and following rows are kept for next flush
+func (s *SQLSink) Flush(ctx context.Context) error {
+	return s.buffer.flush(s.BatchSize, func(batch []interface{}) error {
+		rows := make([]roomRow, len(batch))
+		for i := range batch {
+			rows[i] = batch[i].(roomRow)
+		}
+		return s.insert(ctx, rows)
+	})
+}
+
+// insert rows in a single transaction
+func (s *SQLSink) insert(ctx context.Context, rows []roomRow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	placeholders := make([]string, 9)
+	for i := range placeholders {
+		placeholders[i] = s.dialect.placeholder(i + 1)
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (time, account, location_id, location, room_id, room, current_temperature, target_temperature, run_mode) VALUES (%s)",
+		s.Table, strings.Join(placeholders, ", ")))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row.timestamp, row.account, row.locationId, row.location, row.roomId, row.room, row.current, row.target, row.runMode); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to insert rows: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit rows: %w", err)
+	}
+	return nil
+}
+
+// Cleanup delete rows older than retention, return number of deleted rows
+func (s *SQLSink) Cleanup(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE time < %s", s.Table, s.dialect.placeholder(1)), now.Add(-s.Retention).UTC())
+	if err != nil {
+		return 0, fmt.Errorf("unable to delete old rows: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLSink) logCleanup(ctx context.Context) {
+	deleted, err := s.Cleanup(ctx, time.Now())
+	if err != nil {
+		log.Printf("sql: %v\n", err)
+	} else if deleted > 0 {
+		log.Printf("sql: %d rows older than %v deleted\n", deleted, s.Retention)
+	}
+}
+
+// sinkError count a background insert failure
+func (s *SQLSink) sinkError() {
+	if s.Metrics != nil {
+		s.Metrics.SinkError(s.Name())
+	}
+}
+
+func (s *SQLSink) flushInterval() time.Duration {
+	if s.FlushInterval <= 0 {
+		return DefaultSQLFlushInterval
+	}
+	return s.FlushInterval
+}
+
+func (s *SQLSink) cleanupInterval() time.Duration {
+	if s.CleanupInterval <= 0 {
+		return DefaultSQLCleanupInterval
+	}
+	return s.CleanupInterval
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestSQLSink(t *testing.T) (*SQLSink, func()) {
+	dir, err := ioutil.TempDir("", "warmup4ie2mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSQLSink("sqlite://"+filepath.Join(dir, "history.db"), "")
+	if err != nil {
+		os.RemoveAll(dir)
+		// go-sqlite3 is a stub without cgo
+		if strings.Contains(err.Error(), "cgo") {
+			t.Skipf("sqlite unavailable: %v", err)
+		}
+		t.Fatalf("unable to open database: %v", err)
+	}
+	return s, func() {
+		s.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (s *SQLSink) count(t *testing.T) int {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM " + s.Table).Scan(&count); err != nil {
+		t.Fatalf("unable to count rows: %v", err)
+	}
+	return count
+}
+
+func TestParseDSN(t *testing.T) {
+	for _, test := range []struct {
+		dsn    string
+		driver string
+		source string
+	}{
+		{"postgres://user:secret@db/warmup?sslmode=disable", "postgres", "postgres://user:secret@db/warmup?sslmode=disable"},
+		{"postgresql://db/warmup", "postgres", "postgresql://db/warmup"},
+		{"sqlite:///var/lib/warmup/history.db", "sqlite3", "/var/lib/warmup/history.db"},
+		{"file:history.db?cache=shared", "sqlite3", "file:history.db?cache=shared"},
+	} {
+		dialect, source, err := ParseDSN(test.dsn)
+		if err != nil || dialect.driver != test.driver || source != test.source {
+			t.Errorf("bad parsing of %s, expected: %s %s, actual: %s %s %v", test.dsn, test.driver, test.source, dialect.driver, source, err)
+		}
+	}
+	if _, _, err := ParseDSN("mysql://db/warmup"); err == nil {
+		t.Errorf("error expected with unsupported database")
+	}
+}
+
+func TestSQLSink_Write(t *testing.T) {
+	s, clean := openTestSQLSink(t)
+	defer clean()
+	s.BatchSize = 1
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	timestamp := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	s.Write("home", *rooms, timestamp)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.buffer.pending) != 0 || s.count(t) != 2 {
+		t.Errorf("2 rows expected, actual: %d, pending: %v", s.count(t), s.buffer.pending)
+	}
+
+	var (
+		account, room, runMode string
+		current, target        float64
+		inserted               time.Time
+	)
+	err := s.db.QueryRow("SELECT time, account, room, current_temperature, target_temperature, run_mode FROM room_history WHERE room_id = 2").
+		Scan(&inserted, &account, &room, &current, &target, &runMode)
+	if err != nil {
+		t.Fatalf("unable to read row: %v", err)
+	}
+	if !inserted.Equal(timestamp) || account != "home" || room != "Room2" || current != 20 || target != 25 || runMode != "forced" {
+		t.Errorf("bad row: %v %s %s %v %v %s", inserted, account, room, current, target, runMode)
+	}
+
+	// Schema creation is idempotent
+	if err := s.createSchema(); err != nil {
+		t.Errorf("schema must be created only once: %v", err)
+	}
+}
+
+func TestSQLSink_Cleanup(t *testing.T) {
+	s, clean := openTestSQLSink(t)
+	defer clean()
+	s.Retention = 24 * time.Hour
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	now := time.Now()
+	s.Write("home", (*rooms)[:1], now.Add(-48*time.Hour))
+	s.Write("home", (*rooms)[:1], now.Add(-time.Hour))
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deleted, err := s.Cleanup(context.Background(), now)
+	if err != nil || deleted != 1 {
+		t.Errorf("only old row must be deleted, actual: %d %v", deleted, err)
+	}
+	if s.count(t) != 1 {
+		t.Errorf("recent row must be kept")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const (
+	StatusOk    = "ok"
+	StatusError = "error"
+	StatusStale = "stale"
+
+	DefaultRetryDelay = 15 * time.Second
+	DefaultStaleAfter = 3
+)
+
+// PollStatus is the result of the last polls, published on status topic
+type PollStatus struct {
+	Status              string     `json:"status"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	// Published room values are outdated
+	Stale     bool      `json:"stale"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Backoff computes delay before retrying a failed poll
+type Backoff struct {
+	// Delay after the first failure, doubled on each new failure
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b Backoff) Delay(failures int) time.Duration {
+	delay := b.Initial
+	if delay <= 0 {
+		return b.Max
+	}
+	for i := 1; i < failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		return b.Max
+	}
+	return delay
+}
+
+// IsUnrecoverable return true for errors that won't disappear by retrying
+func IsUnrecoverable(err error) bool {
+	return errors.Is(err, warmup4ie.ErrInvalidCredentials)
+}
+
+// Status return status of last polls
+func (m *Monitor) Status() PollStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+func (m *Monitor) recordSuccess(timestamp time.Time) {
+	m.mutex.Lock()
+	recovered := m.status.ConsecutiveFailures > 0
+	m.status = PollStatus{Status: StatusOk, LastSuccess: &timestamp, Timestamp: timestamp}
+	m.mutex.Unlock()
+
+	if recovered {
+		m.publishStatus()
+		m.writeEvent(&Event{Event: EventPollRecovered, Account: m.Name, Timestamp: timestamp.UTC()})
+	}
+}
+
+// recordFailure update status with error and return the number of consecutive failures
+func (m *Monitor) recordFailure(err error, timestamp time.Time) int {
+	m.mutex.Lock()
+	m.status.ConsecutiveFailures++
+	m.status.LastError = err.Error()
+	m.status.Timestamp = timestamp
+	m.status.Stale = m.StaleAfter > 0 && m.status.ConsecutiveFailures >= m.StaleAfter
+	m.status.Status = StatusError
+	if m.status.Stale {
+		m.status.Status = StatusStale
+	}
+	failures := m.status.ConsecutiveFailures
+	m.mutex.Unlock()
+
+	m.publishStatus()
+	if failures == 1 {
+		m.writeEvent(&Event{Event: EventPollFailed, Account: m.Name, Error: err.Error(), Timestamp: timestamp.UTC()})
+	}
+	return failures
+}
+
+func (m *Monitor) publishStatus() {
+	topic, err := m.Topics.StatusTopic()
+	if err != nil {
+		log.Printf("unable to publish status: %v\n", err)
+		return
+	}
+	status := m.Status()
+	payload, err := json.Marshal(&status)
+	if err != nil {
+		log.Printf("unable to marshal status: %v\n", err)
+		return
+	}
+	if err := m.publish(topic, string(payload), &mqttdevice.Properties{ContentType: "application/json"}); err != nil {
+		log.Printf("unable to publish status: %v\n", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+type failingThermostat struct {
+	thermostatMock
+	err error
+}
+
+func (t *failingThermostat) ListRooms() (*[]warmup4ie.Room, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.thermostatMock.ListRooms()
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Second, Max: 1 * time.Minute}
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 1 * time.Minute, 1 * time.Minute}
+	for i, e := range expected {
+		if d := b.Delay(i + 1); d != e {
+			t.Errorf("bad delay after %d failures, expected: %v, actual: %v", i+1, e, d)
+		}
+	}
+	if d := (Backoff{Max: 3 * time.Minute}).Delay(1); d != 3*time.Minute {
+		t.Errorf("max delay expected without initial delay, actual: %v", d)
+	}
+}
+
+func TestMonitor_RecordFailure(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	th := failingThermostat{err: fmt.Errorf("timeout")}
+	now := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	m := Monitor{Thermostat: &th, Publisher: p, Topics: DefaultTopicLayout("room"), StaleAfter: 2, now: func() time.Time { return now }}
+
+	var status PollStatus
+	for i := 1; i <= 2; i++ {
+		err := m.poll()
+		if err == nil {
+			t.Fatalf("error expected")
+		}
+		if failures := m.recordFailure(err, m.timestamp()); failures != i {
+			t.Errorf("bad failures count, expected: %d, actual: %d", i, failures)
+		}
+		if err := json.Unmarshal([]byte(p.msg["room/status"].(string)), &status); err != nil {
+			t.Fatalf("unable to decode status: %v", err)
+		}
+		if status.ConsecutiveFailures != i || status.LastError != "timeout" {
+			t.Errorf("bad status: %+v", status)
+		}
+	}
+	if !status.Stale || status.Status != StatusStale {
+		t.Errorf("stale status expected after 2 failures: %+v", status)
+	}
+
+	th.err = nil
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.recordSuccess(now)
+	if err := json.Unmarshal([]byte(p.msg["room/status"].(string)), &status); err != nil {
+		t.Fatalf("unable to decode status: %v", err)
+	}
+	if status.Status != StatusOk || status.ConsecutiveFailures != 0 || status.Stale || status.LastSuccess == nil {
+		t.Errorf("ok status expected after success: %+v", status)
+	}
+}
+
+func TestMonitor_RunUnrecoverable(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	th := failingThermostat{err: &warmup4ie.Error{Method: "userLogin", Err: warmup4ie.ErrInvalidCredentials}}
+	m := Monitor{Thermostat: &th, Publisher: p, Topics: DefaultTopicLayout("room"), IdleTime: time.Millisecond}
+
+	done := make(chan error)
+	go func() { done <- m.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, warmup4ie.ErrInvalidCredentials) {
+			t.Errorf("invalid credentials error expected, actual: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("monitor must stop on unrecoverable error")
+	}
+}
+
+func TestRunMonitors_IsolatedFailure(t *testing.T) {
+	// Monitors run concurrently, each one has its own publisher
+	office := fakePublisher{msg: make(map[string]interface{})}
+	home := fakePublisher{msg: make(map[string]interface{})}
+	th := failingThermostat{err: &warmup4ie.Error{Method: "userLogin", Err: warmup4ie.ErrInvalidCredentials}}
+	failing := &Monitor{Name: "office", Thermostat: &th, Publisher: office, Topics: DefaultTopicLayout("office"), IdleTime: time.Millisecond}
+	working := &Monitor{Name: "home", Thermostat: &thermostatMock{}, Publisher: home, Topics: DefaultTopicLayout("home"), IdleTime: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := runMonitors(ctx, []*Monitor{failing, working})
+	select {
+	case <-done:
+		t.Fatalf("monitors must keep running while an account works")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if working.Status().LastSuccess == nil {
+		t.Errorf("working account must be polled")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Errorf("monitors must stop when context is cancelled")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Interval of keep alive comments sent to server-sent events clients
+	DefaultStreamKeepAlive = 30 * time.Second
+	// Events buffered by client, slow clients are disconnected when full
+	DefaultStreamBuffer = 64
+)
+
+// Stream events
+const (
+	// Rooms of last polls, sent on connection
+	StreamSnapshot = "snapshot"
+	// Room appeared or one of its values changed
+	StreamRoom = "room"
+	// Room disappeared from poll results, with its last known values
+	StreamRoomRemoved = "room_removed"
+)
+
+// StreamEvent is the json document sent to stream clients
+type StreamEvent struct {
+	Event     string    `json:"event"`
+	Rooms     []APIRoom `json:"rooms,omitempty"`
+	Room      *APIRoom  `json:"room,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RoomStream broadcasts room changes of monitors to subscribed clients
+type RoomStream struct {
+	mutex   sync.Mutex
+	clients map[chan *StreamEvent]bool
+	closed  bool
+}
+
+func NewRoomStream() *RoomStream {
+	return &RoomStream{clients: make(map[chan *StreamEvent]bool)}
+}
+
+// Subscribe return channel receiving events until unsubscribe is called, the channel is closed
+// when client is too slow to receive events or when stream is closed
+func (s *RoomStream) Subscribe() (events <-chan *StreamEvent, unsubscribe func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client := make(chan *StreamEvent, DefaultStreamBuffer)
+	if s.closed {
+		close(client)
+		return client, func() {}
+	}
+	s.clients[client] = true
+	return client, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.clients[client] {
+			delete(s.clients, client)
+			close(client)
+		}
+	}
+}
+
+// Publish send events to all clients, clients which buffer is full are disconnected
+func (s *RoomStream) Publish(events []*StreamEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for client := range s.clients {
+		if !sendEvents(client, events) {
+			log.Printf("stream: client too slow, disconnected\n")
+			delete(s.clients, client)
+			close(client)
+		}
+	}
+}
+
+// sendEvents queue events to client without blocking, return false if its buffer is full
+func sendEvents(client chan *StreamEvent, events []*StreamEvent) bool {
+	for _, event := range events {
+		select {
+		case client <- event:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Close disconnect all clients, new clients are disconnected immediately
+func (s *RoomStream) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client)
+	}
+}
+
+func (s *RoomStream) Name() string {
+	return "stream"
+}
+
+// WriteRooms send events of rooms changed since previous poll to clients
+func (s *RoomStream) WriteRooms(snapshot *RoomSnapshot) error {
+	s.Publish(streamEvents(snapshot.Account, snapshot.Previous, snapshot.Rooms, snapshot.Timestamp))
+	return nil
+}
+
+// WriteEvent does nothing, clients only receive room changes
+func (s *RoomStream) WriteEvent(event *Event) error {
+	return nil
+}
+
+// streamEvents return events of rooms changed between two polls, all rooms are sent on first poll
+func streamEvents(account string, previous map[int]warmup4ie.Room, rooms []warmup4ie.Room, timestamp time.Time) []*StreamEvent {
+	var events []*StreamEvent
+	event := func(name string, room *warmup4ie.Room) {
+		events = append(events, &StreamEvent{
+			Event:     name,
+			Room:      &APIRoom{RoomState: NewRoomState(room, timestamp), Account: account},
+			Timestamp: timestamp.UTC(),
+		})
+	}
+	polled := make(map[int]bool, len(rooms))
+	for i := range rooms {
+		room := &rooms[i]
+		polled[room.Id] = true
+		before, ok := previous[room.Id]
+		if !ok || roomChanged(&before, room) {
+			event(StreamRoom, room)
+		}
+	}
+	for id, before := range previous {
+		if !polled[id] {
+			room := before
+			event(StreamRoomRemoved, &room)
+		}
+	}
+	return events
+}
+
+// roomChanged return true if a value of the room state changed
+func roomChanged(before *warmup4ie.Room, after *warmup4ie.Room) bool {
+	b, a := NewRoomState(before, time.Time{}), NewRoomState(after, time.Time{})
+	return b.CurrentTemperature != a.CurrentTemperature || b.TargetTemperature != a.TargetTemperature || b.label() != a.label()
+}
+
+// StreamHandler streams room events as server-sent events, or on a websocket when the request asks for an upgrade.
+// A snapshot of the rooms of last polls is sent on connection, followed by an event on each room change.
+type StreamHandler struct {
+	Monitors []*Monitor
+	Stream   *RoomStream
+	// Interval of keep alive comments of server-sent events
+	KeepAlive time.Duration
+	now       func() time.Time
+}
+
+func NewStreamHandler(monitors []*Monitor, stream *RoomStream) *StreamHandler {
+	return &StreamHandler{Monitors: monitors, Stream: stream, KeepAlive: DefaultStreamKeepAlive}
+}
+
+func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" not allowed")
+		return
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: h.serveWebsocket}.ServeHTTP(w, r)
+		return
+	}
+	h.serveEvents(w, r)
+}
+
+// snapshot subscribe to stream and return the first event to send, subscribing first ensures no change is missed
+func (h *StreamHandler) snapshot() (*StreamEvent, <-chan *StreamEvent, func()) {
+	events, unsubscribe := h.Stream.Subscribe()
+	rooms := (&APIHandler{Monitors: h.Monitors}).rooms().([]APIRoom)
+	return &StreamEvent{Event: StreamSnapshot, Rooms: rooms, Timestamp: h.timestamp().UTC()}, events, unsubscribe
+}
+
+func (h *StreamHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "streaming not supported")
+		return
+	}
+	snapshot, events, unsubscribe := h.snapshot()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(event *StreamEvent) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := send(snapshot); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(h.keepAlive())
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *StreamHandler) serveWebsocket(ws *websocket.Conn) {
+	defer ws.Close()
+	snapshot, events, unsubscribe := h.snapshot()
+	defer unsubscribe()
+	// Messages of client are ignored, reading detects when it disconnects
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		var message string
+		for websocket.Message.Receive(ws, &message) == nil {
+		}
+	}()
+	if err := websocket.JSON.Send(ws, snapshot); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-disconnected:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *StreamHandler) keepAlive() time.Duration {
+	if h.KeepAlive <= 0 {
+		return DefaultStreamKeepAlive
+	}
+	return h.KeepAlive
+}
+
+func (h *StreamHandler) timestamp() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
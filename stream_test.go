@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamEvents(t *testing.T) {
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	timestamp := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	if events := streamEvents("home", nil, *rooms, timestamp); len(events) != 2 || events[0].Event != StreamRoom {
+		t.Errorf("all rooms expected on first poll, actual: %v", events)
+	}
+
+	previous := map[int]warmup4ie.Room{1: (*rooms)[0], 2: (*rooms)[1], 3: {Id: 3, Name: "Room3"}}
+	previous[2] = warmup4ie.Room{Id: 2, Name: "Room2", RunMode: warmup4ie.RunModeForced, TargetTemp: warmup4ie.Temperature{RawTemperature: 250}}
+	events := streamEvents("home", previous, *rooms, timestamp)
+	if len(events) != 2 {
+		t.Fatalf("2 events expected, actual: %v", events)
+	}
+	if events[0].Event != StreamRoom || events[0].Room.Id != 2 || events[0].Room.CurrentTemperature != 20 || events[0].Room.Account != "home" {
+		t.Errorf("changed current temperature of room 2 expected, actual: %+v", events[0].Room)
+	}
+	if events[1].Event != StreamRoomRemoved || events[1].Room.Id != 3 {
+		t.Errorf("removed room 3 expected, actual: %+v", events[1])
+	}
+}
+
+// newStreamServer return a server streaming events of a polled monitor
+func newStreamServer(t *testing.T) (*Monitor, *httptest.Server) {
+	m, _ := newCommandMonitor()
+	m.Name = "home"
+	stream := NewRoomStream()
+	m.Sinks = []Sink{stream}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m, httptest.NewServer(NewStreamHandler([]*Monitor{m}, stream))
+}
+
+// changeRoom make next poll see a change of room 1
+func changeRoom(t *testing.T, m *Monitor) {
+	m.mutex.Lock()
+	room := m.rooms[1]
+	room.TargetTemp = warmup4ie.Temperature{RawTemperature: 180}
+	m.rooms[1] = room
+	m.mutex.Unlock()
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamHandler_Events(t *testing.T) {
+	m, server := newStreamServer(t)
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("event stream expected, actual: %s", response.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(response.Body)
+	next := func() *StreamEvent {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unable to read event: %v", err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				var event StreamEvent
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+					t.Fatalf("unable to decode event %s: %v", line, err)
+				}
+				return &event
+			}
+		}
+	}
+	if event := next(); event.Event != StreamSnapshot || len(event.Rooms) != 2 {
+		t.Errorf("snapshot of 2 rooms expected, actual: %+v", event)
+	}
+	changeRoom(t, m)
+	if event := next(); event.Event != StreamRoom || event.Room.Id != 1 || event.Room.TargetTemperature != 22 {
+		t.Errorf("change of room 1 expected, actual: %+v", event)
+	}
+}
+
+func TestStreamHandler_Websocket(t *testing.T) {
+	m, server := newStreamServer(t)
+	defer server.Close()
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1), "", server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ws.Close()
+	var event StreamEvent
+	if err := websocket.JSON.Receive(ws, &event); err != nil || event.Event != StreamSnapshot || len(event.Rooms) != 2 {
+		t.Errorf("snapshot of 2 rooms expected, actual: %+v %v", event, err)
+	}
+	changeRoom(t, m)
+	event = StreamEvent{}
+	if err := websocket.JSON.Receive(ws, &event); err != nil || event.Event != StreamRoom || event.Room.Id != 1 {
+		t.Errorf("change of room 1 expected, actual: %+v %v", event, err)
+	}
+
+	m.Sinks[0].(*RoomStream).Close()
+	if err := websocket.JSON.Receive(ws, &event); err == nil {
+		t.Errorf("websocket must be closed with stream")
+	}
+}
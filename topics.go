@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+const (
+	DefaultCurrentTopic       = "{{.Base}}/{{.Room}}/temperature/floor"
+	DefaultTargetTopic        = "{{.Base}}/{{.Room}}/temperature/floor/target"
+	DefaultStateTopic         = "{{.Base}}/{{.Room}}/state"
+	DefaultTargetCommandTopic = "{{.Base}}/{{.Room}}/temperature/floor/target/set"
+	DefaultModeCommandTopic   = "{{.Base}}/{{.Room}}/mode/set"
+	DefaultStatusTopic        = "{{.Base}}/status"
+	DefaultAvailabilityTopic  = "{{.Base}}/availability"
+	DefaultAlertsTopic        = "{{.Base}}/alerts"
+)
+
+// TopicTemplates are go templates of topics, empty values are replaced by defaults
+type TopicTemplates struct {
+	Current       string `yaml:"current"`
+	Target        string `yaml:"target"`
+	State         string `yaml:"state"`
+	TargetCommand string `yaml:"target_command"`
+	ModeCommand   string `yaml:"mode_command"`
+	// Bridge status, room fields are empty
+	Status string `yaml:"status"`
+	// Retained online/offline message of the bridge, room fields are empty
+	Availability string `yaml:"availability"`
+	// Raised and cleared alerts of rooms
+	Alerts string `yaml:"alerts"`
+}
+
+// RoomKey defines how a room is identified in topics
+type RoomKey string
+
+const (
+	// Lower case room name, the historical topics
+	RoomKeyName RoomKey = "name"
+	// Slug of the room name, safe for names with spaces, accents or wildcards
+	RoomKeySlug RoomKey = "slug"
+	// Room id, stable when the room is renamed
+	RoomKeyId RoomKey = "id"
+)
+
+func ParseRoomKey(value string) (RoomKey, error) {
+	switch key := RoomKey(strings.ToLower(value)); key {
+	case RoomKeyName, RoomKeySlug, RoomKeyId:
+		return key, nil
+	case "":
+		return RoomKeyName, nil
+	default:
+		return "", fmt.Errorf("invalid room key '%s', expected %s, %s or %s", value, RoomKeyName, RoomKeySlug, RoomKeyId)
+	}
+}
+
+// TopicData is the data available in topic templates
+type TopicData struct {
+	// Topic prefix
+	Base string
+	// Room key, slug of the room name, room id or name mapped from configuration
+	Room string
+	// Raw room values, use slug function before using them in a topic
+	RoomId       int
+	RoomName     string
+	LocationId   int
+	LocationName string
+}
+
+// TopicLayout builds topics of each published value from go templates
+type TopicLayout struct {
+	Base          string
+	RoomKey       RoomKey
+	RoomNames     map[int]string
+	current       *template.Template
+	target        *template.Template
+	state         *template.Template
+	targetCommand *template.Template
+	modeCommand   *template.Template
+	status        *template.Template
+	availability  *template.Template
+	alerts        *template.Template
+}
+
+func NewTopicLayout(base string, templates TopicTemplates) (*TopicLayout, error) {
+	l := TopicLayout{Base: base, RoomKey: RoomKeyName, RoomNames: make(map[int]string)}
+	var err error
+	if l.current, err = parseTopicTemplate("current", templates.Current, DefaultCurrentTopic); err != nil {
+		return nil, err
+	}
+	if l.target, err = parseTopicTemplate("target", templates.Target, DefaultTargetTopic); err != nil {
+		return nil, err
+	}
+	if l.state, err = parseTopicTemplate("state", templates.State, DefaultStateTopic); err != nil {
+		return nil, err
+	}
+	if l.targetCommand, err = parseTopicTemplate("target command", templates.TargetCommand, DefaultTargetCommandTopic); err != nil {
+		return nil, err
+	}
+	if l.modeCommand, err = parseTopicTemplate("mode command", templates.ModeCommand, DefaultModeCommandTopic); err != nil {
+		return nil, err
+	}
+	if l.status, err = parseTopicTemplate("status", templates.Status, DefaultStatusTopic); err != nil {
+		return nil, err
+	}
+	if l.availability, err = parseTopicTemplate("availability", templates.Availability, DefaultAvailabilityTopic); err != nil {
+		return nil, err
+	}
+	if l.alerts, err = parseTopicTemplate("alerts", templates.Alerts, DefaultAlertsTopic); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// DefaultTopicLayout return the historical layout: <base>/<room name>/temperature/floor[/target]
+func DefaultTopicLayout(base string) *TopicLayout {
+	l, err := NewTopicLayout(base, TopicTemplates{})
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func parseTopicTemplate(name, text, defaultText string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	t, err := template.New(name).Funcs(template.FuncMap{"slug": Slug}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s topic template '%s': %w", name, text, err)
+	}
+	return t, nil
+}
+
+func (l *TopicLayout) CurrentTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.current, room)
+}
+
+func (l *TopicLayout) TargetTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.target, room)
+}
+
+func (l *TopicLayout) StateTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.state, room)
+}
+
+func (l *TopicLayout) TargetCommandTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.targetCommand, room)
+}
+
+func (l *TopicLayout) ModeCommandTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.modeCommand, room)
+}
+
+func (l *TopicLayout) StatusTopic() (string, error) {
+	return l.executeData(l.status, &TopicData{Base: l.Base})
+}
+
+func (l *TopicLayout) AvailabilityTopic() (string, error) {
+	return l.executeData(l.availability, &TopicData{Base: l.Base})
+}
+
+func (l *TopicLayout) AlertsTopic(room *warmup4ie.Room) (string, error) {
+	return l.execute(l.alerts, room)
+}
+
+// RoomKeyOf return the identifier of room used in topics
+func (l *TopicLayout) RoomKeyOf(room *warmup4ie.Room) string {
+	name, mapped := l.RoomNames[room.Id]
+	if !mapped {
+		if l.RoomKey == RoomKeyId {
+			return strconv.Itoa(room.Id)
+		}
+		name = room.Name
+	}
+	if l.RoomKey == RoomKeyName {
+		return strings.ToLower(name)
+	}
+	return Slug(name)
+}
+
+// ErrInvalidTopic is returned when a topic can't be built from its template, for instance with a room name containing a wildcard
+var ErrInvalidTopic = errors.New("invalid topic")
+
+func (l *TopicLayout) execute(t *template.Template, room *warmup4ie.Room) (string, error) {
+	data := TopicData{
+		Base:         l.Base,
+		Room:         l.RoomKeyOf(room),
+		RoomId:       room.Id,
+		RoomName:     room.Name,
+		LocationId:   room.LocationId,
+		LocationName: room.LocationName,
+	}
+	topic, err := l.executeData(t, &data)
+	if err != nil {
+		return "", fmt.Errorf("room %s: %w", room.Name, err)
+	}
+	return topic, nil
+}
+
+func (l *TopicLayout) executeData(t *template.Template, data *TopicData) (string, error) {
+	var topic bytes.Buffer
+	if err := t.Execute(&topic, data); err != nil {
+		return "", fmt.Errorf("%w: unable to build %s topic: %v", ErrInvalidTopic, t.Name(), err)
+	}
+	if err := validateTopic(topic.String()); err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrInvalidTopic, t.Name(), err)
+	}
+	return topic.String(), nil
+}
+
+func validateTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+	if strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("topic '%s' contains wildcard or null character", topic)
+	}
+	return nil
+}
+
+// ParseRoomNames parse room names mapping with format '<id>=<name>,<id>=<name>'
+func ParseRoomNames(value string) (map[int]string, error) {
+	names := make(map[int]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("invalid room name mapping '%s', expected <id>=<name>", entry)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid room id in mapping '%s': %w", entry, err)
+		}
+		names[id] = strings.TrimSpace(fields[1])
+	}
+	return names, nil
+}
+
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ñ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'œ': "oe",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'ÿ': "y", 'ß': "ss",
+}
+
+// Slug return a topic level safe version of name: lower case ascii letters, digits, '-' and '_'
+func Slug(name string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		var part string
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			part = string(r)
+		case transliterations[r] != "":
+			part = transliterations[r]
+		default:
+			// Separators, wildcards and any other character
+			dash = slug.Len() > 0
+			continue
+		}
+		if dash {
+			slug.WriteRune('-')
+			dash = false
+		}
+		slug.WriteString(part)
+	}
+	if slug.Len() == 0 {
+		return "unnamed"
+	}
+	return slug.String()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"Room1":                "room1",
+		"Living room":          "living-room",
+		"Salle de bain/Étage":  "salle-de-bain-etage",
+		"Kid's #1 + guest":     "kid-s-1-guest",
+		"  Chambre d'à côté  ": "chambre-d-a-cote",
+		"Bad_Küche":            "bad_kuche",
+		"###":                  "unnamed",
+	}
+	for name, expected := range cases {
+		if actual := Slug(name); actual != expected {
+			t.Errorf("bad slug for '%s', expected: %s, actual: %s", name, expected, actual)
+		}
+	}
+}
+
+func TestTopicLayout(t *testing.T) {
+	room := warmup4ie.Room{Id: 1234, Name: "Salle de bain", LocationId: 42, LocationName: "Maison"}
+
+	l := DefaultTopicLayout("home")
+	// Historical topics with lower case room name by default
+	if topic, err := l.CurrentTopic(&room); err != nil || topic != "home/salle de bain/temperature/floor" {
+		t.Errorf("bad current topic: %v (%v)", topic, err)
+	}
+
+	l.RoomKey = RoomKeySlug
+	if topic, err := l.CurrentTopic(&room); err != nil || topic != "home/salle-de-bain/temperature/floor" {
+		t.Errorf("bad current topic keyed by slug: %v (%v)", topic, err)
+	}
+	if topic, err := l.TargetTopic(&room); err != nil || topic != "home/salle-de-bain/temperature/floor/target" {
+		t.Errorf("bad target topic: %v (%v)", topic, err)
+	}
+
+	if topic, err := l.ModeCommandTopic(&room); err != nil || topic != "home/salle-de-bain/mode/set" {
+		t.Errorf("bad mode command topic: %v (%v)", topic, err)
+	}
+	if topic, err := l.AvailabilityTopic(); err != nil || topic != "home/availability" {
+		t.Errorf("bad availability topic: %v (%v)", topic, err)
+	}
+
+	l.RoomKey = RoomKeyId
+	if topic, err := l.StateTopic(&room); err != nil || topic != "home/1234/state" {
+		t.Errorf("bad state topic keyed by id: %v (%v)", topic, err)
+	}
+
+	l.RoomNames = map[int]string{1234: "Main bathroom"}
+	if topic, err := l.StateTopic(&room); err != nil || topic != "home/main-bathroom/state" {
+		t.Errorf("bad state topic with mapped name: %v (%v)", topic, err)
+	}
+	l.RoomKey = RoomKeyName
+	if topic, err := l.StateTopic(&room); err != nil || topic != "home/main bathroom/state" {
+		t.Errorf("bad state topic with mapped name keyed by name: %v (%v)", topic, err)
+	}
+}
+
+func TestTopicLayout_CustomTemplate(t *testing.T) {
+	room := warmup4ie.Room{Id: 1234, Name: "Bathroom", LocationId: 42, LocationName: "My home"}
+
+	l, err := NewTopicLayout("warmup", TopicTemplates{Current: "{{.Base}}/{{slug .LocationName}}/{{.RoomId}}/current"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if topic, err := l.CurrentTopic(&room); err != nil || topic != "warmup/my-home/1234/current" {
+		t.Errorf("bad current topic: %v (%v)", topic, err)
+	}
+
+	l, err = NewTopicLayout("warmup", TopicTemplates{Current: "{{.Base}}/{{.RoomName}}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	room.Name = "Room #1"
+	if _, err := l.CurrentTopic(&room); err == nil {
+		t.Errorf("error expected for topic with wildcard")
+	}
+
+	if _, err := NewTopicLayout("warmup", TopicTemplates{ModeCommand: "{{.Base"}); err == nil {
+		t.Errorf("error expected for invalid template")
+	}
+}
+
+func TestParseRoomNames(t *testing.T) {
+	names, err := ParseRoomNames("1234=Bathroom, 5678 = Kitchen")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(names) != 2 || names[1234] != "Bathroom" || names[5678] != "Kitchen" {
+		t.Errorf("bad room names: %v", names)
+	}
+
+	if _, err := ParseRoomNames("Bathroom"); err == nil {
+		t.Errorf("error expected for mapping without id")
+	}
+	if _, err := ParseRoomNames("abc=Bathroom"); err == nil {
+		t.Errorf("error expected for invalid room id")
+	}
+}
@@ -0,0 +1,60 @@
+package warmup4ie
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// Email or password refused by warmup server
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// Access token refused by warmup server
+	ErrUnauthorized = errors.New("unauthorized")
+	// Request refused by warmup server
+	ErrRejected = errors.New("request rejected")
+	// Warmup server failed to process request
+	ErrUnavailable = errors.New("warmup server unavailable")
+	// Run mode can't be applied to a room
+	ErrUnsupportedRunMode = errors.New("unsupported run mode")
+	// Value out of the accepted range
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// Error is returned when warmup server doesn't process a request
+type Error struct {
+	// Api method of the request
+	Method string
+	// Http status of the response
+	StatusCode int
+	// Error code returned by warmup server, 0 if none
+	ErrorCode int
+	// One of the Err* values
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("warmup %s failed: %v", e.Method, e.Err)
+	if e.StatusCode != 0 && e.StatusCode != http.StatusOK {
+		msg += fmt.Sprintf(", http status: %d", e.StatusCode)
+	}
+	if e.ErrorCode != 0 {
+		msg += fmt.Sprintf(", error code: %d", e.ErrorCode)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newHTTPError(method string, statusCode int) *Error {
+	err := Error{Method: method, StatusCode: statusCode, Err: ErrRejected}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		err.Err = ErrUnauthorized
+	case statusCode >= 500:
+		err.Err = ErrUnavailable
+	}
+	return &err
+}
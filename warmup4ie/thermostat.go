@@ -3,13 +3,17 @@ package warmup4ie
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -19,6 +23,9 @@ const (
 	graphqlUrl = "https://apil.warmup.com/graphql"
 )
 
+// DefaultTimeout is the maximum duration of a request to warmup api, a hung api must not block polls and commands
+const DefaultTimeout = 10 * time.Second
+
 type RunMode int
 
 const (
@@ -46,25 +53,198 @@ func (r *RunMode) MarshalJSON() ([]byte, error) {
 	return json.Marshal(int(*r))
 }
 
+var runModeNames = map[RunMode]string{
+	RunModeOff:    "off",
+	RunModeProg:   "prog",
+	RunModeForced: "forced",
+	RunModeFixed:  "fixed",
+	RunModeFrost:  "frost",
+	RunModeAway:   "away",
+}
+
+// ParseRunMode return run mode from its name
+func ParseRunMode(name string) (RunMode, error) {
+	for mode, n := range runModeNames {
+		if strings.EqualFold(n, strings.TrimSpace(name)) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown run mode '%s': %w", name, ErrInvalidValue)
+}
+
+// ParseTemperature return temperature in celcius degrees from its decimal value, NaN and infinite values are rejected
+func ParseTemperature(value string) (float32, error) {
+	temperature, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+	if err != nil || math.IsNaN(temperature) || math.IsInf(temperature, 0) {
+		return 0, fmt.Errorf("invalid temperature '%s': %w", value, ErrInvalidValue)
+	}
+	return float32(temperature), nil
+}
+
+// checkTemperature return an error if temperature is not a number in the range accepted by thermostats
+func checkTemperature(temperature float32) error {
+	if math.IsNaN(float64(temperature)) || math.IsInf(float64(temperature), 0) || temperature < 0 || temperature > 99 {
+		return fmt.Errorf("temperature %.1f out of range: %w", temperature, ErrInvalidValue)
+	}
+	return nil
+}
+
+// RunModes return all run modes ordered by value
+func RunModes() []RunMode {
+	return []RunMode{RunModeOff, RunModeProg, RunModeForced, RunModeFixed, RunModeFrost, RunModeAway}
+}
+
+// SettableRunModes return run modes accepted by SetRunMode
+func SettableRunModes() []RunMode {
+	return []RunMode{RunModeProg, RunModeFixed}
+}
+
+func (r RunMode) String() string {
+	if name, ok := runModeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
 type Thermostat interface {
 	ListLocations() (*[]Location, error)
 	ListRooms() (*[]Room, error)
+	SetTargetTemperature(roomId int, temperature float32) error
+	SetRunMode(roomId int, mode RunMode) error
 }
 
 type Device struct {
+	apiUrl     string
 	graphqlUrl string
 	email      string
-	token      string
+	password   string
 	client     *http.Client
+	observer   RequestObserver
+	// Read on each login when set, replace email and password
+	credentials CredentialProvider
+
+	mutex sync.Mutex
+	token string
+	// Error of the last login, nil once a token is retrieved
+	loginErr error
+}
+
+// RequestObserver is notified after each request sent to warmup api, statusCode is 0 when no response is received
+type RequestObserver func(method string, statusCode int, duration time.Duration)
+
+// CredentialProvider return account credentials, called on each login to use up to date credentials
+type CredentialProvider func() (email string, password string, err error)
+
+// LoginChecker is implemented by thermostats able to report if their session is valid
+type LoginChecker interface {
+	LoginValid() bool
 }
 
 func NewDevice(email string, password string) (*Device, error) {
-	client := &http.Client{}
-	token, err := retrieveAccesToken(client, tokenUrl, email, password)
+	return NewObservedDevice(email, password, nil)
+}
+
+// NewObservedDevice login to warmup api, observer is notified of each request including login
+func NewObservedDevice(email string, password string, observer RequestObserver) (*Device, error) {
+	d := NewClient(email, password, observer)
+	if _, err := d.renewToken(""); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewClient return a device that logs in on its first request
+func NewClient(email string, password string, observer RequestObserver) *Device {
+	return &Device{apiUrl: tokenUrl, graphqlUrl: graphqlUrl, client: &http.Client{Timeout: DefaultTimeout}, email: email, password: password, observer: observer}
+}
+
+// NewClientWithCredentials return a device that logs in on its first request with credentials read from provider
+func NewClientWithCredentials(credentials CredentialProvider, observer RequestObserver) *Device {
+	return &Device{apiUrl: tokenUrl, graphqlUrl: graphqlUrl, client: &http.Client{Timeout: DefaultTimeout}, credentials: credentials, observer: observer}
+}
+
+// authenticated run request with current access token, a new token is retrieved and request run again
+// if the token is refused
+func (d *Device) authenticated(request func(token string) error) error {
+	d.mutex.Lock()
+	token := d.token
+	// Credentials are rewritten on login, they are read under mutex
+	canLogin := d.password != "" || d.credentials != nil
+	d.mutex.Unlock()
+
+	if token == "" {
+		var err error
+		if token, err = d.renewToken(token); err != nil {
+			return err
+		}
+	}
+	err := request(token)
+	if !errors.Is(err, ErrUnauthorized) || !canLogin {
+		return err
+	}
+	log.Infof("access token refused, login again")
+	if token, err = d.renewToken(token); err != nil {
+		return err
+	}
+	return request(token)
+}
+
+func (d *Device) renewToken(expired string) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.token != expired {
+		// Already renewed by a concurrent request
+		return d.token, nil
+	}
+	if d.credentials != nil {
+		email, password, err := d.credentials()
+		if err != nil {
+			d.loginErr = err
+			return "", fmt.Errorf("unable to read credentials: %w", err)
+		}
+		d.email, d.password = email, password
+	}
+	start := time.Now()
+	token, err := retrieveAccesToken(d.client, d.apiUrl, d.email, d.password)
+	d.observe("userLogin", statusCodeOf(err), time.Since(start))
+	d.loginErr = err
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve access token: %w", err)
+		return "", fmt.Errorf("unable to retrieve access token: %w", err)
 	}
-	return &Device{graphqlUrl: graphqlUrl, client: &http.Client{}, email: email, token: token}, nil
+	d.token = token
+	return token, nil
+}
+
+func (d *Device) observe(method string, statusCode int, duration time.Duration) {
+	if d.observer != nil {
+		d.observer(method, statusCode, duration)
+	}
+}
+
+// statusCodeOf return http status of the response of a failed request, 0 if no response was received
+func statusCodeOf(err error) int {
+	var e *Error
+	if err == nil {
+		return http.StatusOK
+	}
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// accountEmail return email of the account, it can be changed by credentials provider on login
+func (d *Device) accountEmail() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.email
+}
+
+// LoginValid return false when the last login has failed
+func (d *Device) LoginValid() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.token != "" && d.loginErr == nil
 }
 
 func retrieveAccesToken(client *http.Client, url string, email string, password string) (string, error) {
@@ -121,21 +301,34 @@ func parseToken(response *http.Response) (string, error) {
 			Token string
 		}
 	}{}
+	switch {
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return "", &Error{Method: "userLogin", StatusCode: response.StatusCode, Err: ErrInvalidCredentials}
+	case response.StatusCode != http.StatusOK:
+		// Rate limiting, bad requests and server errors may succeed on a later login
+		return "", newHTTPError("userLogin", response.StatusCode)
+	}
 	jsonContent, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", err
 	}
 	if err := json.Unmarshal(jsonContent, jsonResponse); err != nil {
-		return "", err
+		return "", &Error{Method: "userLogin", StatusCode: response.StatusCode, Err: fmt.Errorf("%w: %v", ErrRejected, err)}
+	}
+	if jsonResponse.Status != nil && jsonResponse.Status.Result == "error" {
+		// Only an error result of the login explicitly refuses the credentials
+		return "", &Error{Method: "userLogin", StatusCode: response.StatusCode, Err: ErrInvalidCredentials}
 	}
-	if response.StatusCode != 200 || jsonResponse.Status.Result != "success" {
-		return "", fmt.Errorf("invalid response from Warmup server, code: %v", response.Status)
+	if jsonResponse.Status == nil || jsonResponse.Status.Result != "success" || jsonResponse.Response == nil || jsonResponse.Response.Token == "" {
+		return "", &Error{Method: "userLogin", StatusCode: response.StatusCode, Err: ErrRejected}
 	}
 	return jsonResponse.Response.Token, nil
 }
 
 func (d *Device) ListLocations() (*[]Location, error) {
-	body := strings.NewReader(fmt.Sprintf(`{
+	var response LocationResponse
+	err := d.authenticated(func(token string) error {
+		body := strings.NewReader(fmt.Sprintf(`{
 "account": {
     "email": "%s",
     "token": "%s"
@@ -143,14 +336,14 @@ func (d *Device) ListLocations() (*[]Location, error) {
 "request": {
     "method": "getLocations"
 }
-}`, d.email, d.token))
-
-	var response LocationResponse
-	if err := d.postRequest(tokenUrl, nil, body, &response); err != nil {
+}`, d.accountEmail(), token))
+		return d.postRequest("getLocations", d.apiUrl, nil, body, &response)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if response.Status.Result != "success" {
+	if response.Status == nil || response.Status.Result != "success" {
 		return nil, fmt.Errorf("failed to fetch locations from warmup server: %v", response)
 	}
 
@@ -158,23 +351,149 @@ func (d *Device) ListLocations() (*[]Location, error) {
 }
 
 func (d *Device) ListRooms() (*[]Room, error) {
-	body := strings.NewReader(`{
+	var response RoomResponse
+	err := d.authenticated(func(token string) error {
+		body := strings.NewReader(`{
 "query": "query QUERY{ user{ currentLocation: location { id name rooms{ id roomName runModeInt targetTemp currentTemp thermostat4ies {minTemp maxTemp}}  }}  } "
 }`)
+		headers := []*customHeader{
+			{key: "warmup-authorization", value: token},
+		}
+		return d.postRequest("getRooms", d.graphqlUrl, headers, body, &response)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	var response RoomResponse
-	headers := []*customHeader{
-		{key: "warmup-authorization", value: d.token},
+	if response.Status != "success" || response.Data == nil || response.Data.User == nil || response.Data.User.CurrentLocation == nil {
+		return nil, &Error{Method: "getRooms", StatusCode: http.StatusOK, Err: ErrRejected}
 	}
-	if err := d.postRequest(d.graphqlUrl, headers, body, &response); err != nil {
-		return nil, err
+
+	location := response.Data.User.CurrentLocation
+	for i := range location.Rooms {
+		location.Rooms[i].LocationId = location.Id
+		location.Rooms[i].LocationName = location.Name
+	}
+	return &location.Rooms, nil
+}
+
+// SetTargetTemperature switch room to fixed mode with the given temperature in celcius degrees
+func (d *Device) SetTargetTemperature(roomId int, temperature float32) error {
+	if err := checkTemperature(temperature); err != nil {
+		return err
+	}
+	return d.setProgramme(&programmeRequest{
+		Method:   "setProgramme",
+		RoomId:   roomId,
+		RoomMode: "fixed",
+		Fixed:    &fixedProgramme{FixedTemp: fmt.Sprintf("%03d", int(math.Round(float64(temperature)*10)))},
+	})
+}
+
+// SetRunMode switch room to programmed or fixed mode, other modes are not supported per room
+func (d *Device) SetRunMode(roomId int, mode RunMode) error {
+	settable := false
+	for _, m := range SettableRunModes() {
+		settable = settable || m == mode
+	}
+	if !settable {
+		return fmt.Errorf("unable to set mode %v on room %d: %w", mode, roomId, ErrUnsupportedRunMode)
 	}
+	return d.setProgramme(&programmeRequest{Method: "setProgramme", RoomId: roomId, RoomMode: mode.String()})
+}
+
+// HolidayTimeFormat is the format of holiday start and end exchanged with warmup server, in location time
+const HolidayTimeFormat = "2006-01-02 15:04"
 
-	if response.Status != "success" {
-		return nil, fmt.Errorf("failed to fetch rooms from warmup server: %v", response)
+// SetHoliday switch all rooms of location to holiday mode from start to end, at temperature in celcius degrees
+func (d *Device) SetHoliday(locationId int, start time.Time, end time.Time, temperature float32) error {
+	if !end.After(start) {
+		return fmt.Errorf("holiday end %s must be after start %s: %w", end.Format(HolidayTimeFormat), start.Format(HolidayTimeFormat), ErrInvalidValue)
+	}
+	if err := checkTemperature(temperature); err != nil {
+		return err
 	}
+	return d.setModes(&modesValues{
+		LocId:    locationId,
+		LocMode:  "holiday",
+		HolStart: start.Format(HolidayTimeFormat),
+		HolEnd:   end.Format(HolidayTimeFormat),
+		HolTemp:  fmt.Sprintf("%03d", int(math.Round(float64(temperature)*10))),
+	})
+}
+
+// CancelHoliday switch all rooms of location back to programmed mode
+func (d *Device) CancelHoliday(locationId int) error {
+	return d.setModes(&modesValues{LocId: locationId, LocMode: "prog"})
+}
+
+// modesValues are the location mode values of setModes requests, unused values are '-'
+type modesValues struct {
+	HolEnd    string `json:"holEnd"`
+	FixedTemp string `json:"fixedTemp"`
+	HolStart  string `json:"holStart"`
+	GeoMode   string `json:"geoMode"`
+	HolTemp   string `json:"holTemp"`
+	LocId     int    `json:"locId"`
+	LocMode   string `json:"locMode"`
+}
+
+func (d *Device) setModes(values *modesValues) error {
+	for _, value := range []*string{&values.HolStart, &values.HolEnd, &values.HolTemp} {
+		if *value == "" {
+			*value = "-"
+		}
+	}
+	values.GeoMode = "0"
+	return d.runCommand("setModes", &struct {
+		Method string       `json:"method"`
+		Values *modesValues `json:"values"`
+	}{"setModes", values})
+}
 
-	return &response.Data.User.CurrentLocation.Rooms, nil
+type programmeRequest struct {
+	Method   string          `json:"method"`
+	RoomId   int             `json:"roomId"`
+	RoomMode string          `json:"roomMode"`
+	Fixed    *fixedProgramme `json:"fixed,omitempty"`
+}
+
+type fixedProgramme struct {
+	FixedTemp string `json:"fixedTemp"`
+}
+
+func (d *Device) setProgramme(request *programmeRequest) error {
+	return d.runCommand(request.Method, request)
+}
+
+// runCommand post request with account credentials to warmup api and check result status
+func (d *Device) runCommand(method string, request interface{}) error {
+	type account struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	var response JsonResponse
+	err := d.authenticated(func(token string) error {
+		body, err := json.Marshal(&struct {
+			Account account     `json:"account"`
+			Request interface{} `json:"request"`
+		}{account{d.accountEmail(), token}, request})
+		if err != nil {
+			return fmt.Errorf("unable to build json request: %w", err)
+		}
+		return d.postRequest(method, d.apiUrl, nil, bytes.NewReader(body), &response)
+	})
+	if err != nil {
+		return err
+	}
+	if response.Status == nil || response.Status.Result != "success" {
+		err := Error{Method: method, StatusCode: http.StatusOK, Err: ErrRejected}
+		if response.Response != nil {
+			err.ErrorCode = response.Response.ErrorCode
+		}
+		return &err
+	}
+	return nil
 }
 
 type LocationResponse struct {
@@ -310,6 +629,9 @@ type Room struct {
 		MinTemp Temperature
 		MaxTemp Temperature
 	}
+	// Location of the room, filled from the parent location of the response
+	LocationId   int    `json:"-"`
+	LocationName string `json:"-"`
 }
 
 type JsonResponse struct {
@@ -319,7 +641,7 @@ type JsonResponse struct {
 	Response *struct {
 		ErrorCode int
 	}
-	Message string
+	Message json.RawMessage
 }
 
 var defaultHeaders = http.Header{
@@ -338,7 +660,7 @@ type customHeader struct {
 	value string
 }
 
-func (d *Device) postRequest(url string, headers []*customHeader, body io.Reader, response interface{}) error {
+func (d *Device) postRequest(method string, url string, headers []*customHeader, body io.Reader, response interface{}) error {
 	req, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
 		return fmt.Errorf("unexpected error: %w", err)
@@ -352,14 +674,17 @@ func (d *Device) postRequest(url string, headers []*customHeader, body io.Reader
 	// Force user-agent (no list that starts with golang default value)
 	req.Header.Set("user-agent", defaultHeaders.Get("user-agent"))
 
+	start := time.Now()
 	resp, err := d.client.Do(req)
 	if err != nil {
+		d.observe(method, 0, time.Since(start))
 		return fmt.Errorf("unexpected error: %w", err)
 	}
+	d.observe(method, resp.StatusCode, time.Since(start))
 
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("invalid http status: %d", resp.StatusCode)
+		return newHTTPError(method, resp.StatusCode)
 	}
 
 	jsonContent, err := ioutil.ReadAll(resp.Body)
@@ -2,11 +2,14 @@ package warmup4ie
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -113,6 +116,15 @@ func TestRunMode_UnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestRunMode_String(t *testing.T) {
+	if RunModeFixed.String() != "fixed" {
+		t.Errorf("bad run mode name, expected: fixed, actual: %v", RunModeFixed.String())
+	}
+	if RunMode(42).String() != "unknown(42)" {
+		t.Errorf("bad name for unknown run mode: %v", RunMode(42).String())
+	}
+}
+
 func TestTemperature_GetValue(t *testing.T) {
 	temp := Temperature{RawTemperature: 123}
 	if temp.GetValue() != 12.3 {
@@ -244,6 +256,9 @@ func TestDevice_ListRooms(t *testing.T) {
 	if room1.RunMode != RunModeProg {
 		t.Errorf("invalid runmod expected:%v , actual:%v", RunModeProg, room1.RunMode)
 	}
+	if room1.LocationId != 1234 || room1.LocationName != "Home" {
+		t.Errorf("invalid location expected:%v/%v , actual:%v/%v", 1234, "Home", room1.LocationId, room1.LocationName)
+	}
 
 	room2 := (*rooms)[1]
 	if room2.Id != 91234 {
@@ -254,3 +269,368 @@ func TestDevice_ListRooms(t *testing.T) {
 	}
 
 }
+
+func TestDevice_SetTargetTemperature(t *testing.T) {
+	token := "gkhgkTokenhgj"
+
+	var setProgrammeHandler = func(w http.ResponseWriter, r *http.Request) {
+		content := struct {
+			Account struct {
+				Email string
+				Token string
+			}
+			Request struct {
+				Method   string
+				RoomId   int
+				RoomMode string
+				Fixed    struct{ FixedTemp string }
+			}
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		if content.Account.Token != token || content.Account.Email != "email@test.com" {
+			t.Errorf("bad account in request: %+v", content.Account)
+		}
+		if content.Request.Method != "setProgramme" || content.Request.RoomId != 5678 || content.Request.RoomMode != "fixed" {
+			t.Errorf("bad request: %+v", content.Request)
+		}
+		if content.Request.Fixed.FixedTemp != "215" {
+			t.Errorf("bad fixed temperature, expected: 215, actual: %v", content.Request.Fixed.FixedTemp)
+		}
+		w.WriteHeader(200)
+		_, err := fmt.Fprint(w, `{"status":{"result":"success"},"response":{"method":"setProgramme"},"message":{"duration":"0.121"}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(setProgrammeHandler))
+	defer server.Close()
+
+	device := Device{apiUrl: server.URL, email: "email@test.com", token: token, client: &http.Client{}}
+	if err := device.SetTargetTemperature(5678, 21.5); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, temperature := range []float64{120, math.NaN(), math.Inf(1)} {
+		if err := device.SetTargetTemperature(5678, float32(temperature)); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("invalid value error expected for %v, actual: %v", temperature, err)
+		}
+	}
+}
+
+func TestParseTemperature(t *testing.T) {
+	if temperature, err := ParseTemperature(" 21.5 "); err != nil || temperature != 21.5 {
+		t.Errorf("21.5 expected, actual: %v, %v", temperature, err)
+	}
+	for _, value := range []string{"hot", "NaN", "nan", "Inf", "-Inf", "1e40"} {
+		if _, err := ParseTemperature(value); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("invalid value error expected for %s, actual: %v", value, err)
+		}
+	}
+}
+
+func TestDevice_SetRunMode(t *testing.T) {
+	var setProgrammeHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := fmt.Fprint(w, `{"status":{"result":"error"},"response":{"errorCode":12},"message":{"duration":"0.121"}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(setProgrammeHandler))
+	defer server.Close()
+
+	device := Device{apiUrl: server.URL, email: "email@test.com", token: "token", client: &http.Client{}}
+	err := device.SetRunMode(5678, RunModeProg)
+	var warmupErr *Error
+	if !errors.As(err, &warmupErr) || !errors.Is(err, ErrRejected) || warmupErr.ErrorCode != 12 {
+		t.Errorf("rejected error with code 12 expected, actual: %v", err)
+	}
+	if err := device.SetRunMode(5678, RunModeFrost); !errors.Is(err, ErrUnsupportedRunMode) {
+		t.Errorf("unsupported run mode error expected, actual: %v", err)
+	}
+}
+
+func TestDevice_SetHoliday(t *testing.T) {
+	var values map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := struct {
+			Request struct {
+				Method string
+				Values map[string]interface{}
+			}
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		if content.Request.Method != "setModes" {
+			t.Errorf("bad method: %s", content.Request.Method)
+		}
+		values = content.Request.Values
+		fmt.Fprint(w, `{"status":{"result":"success"},"response":{"method":"setModes"}}`)
+	}))
+	defer server.Close()
+
+	device := Device{apiUrl: server.URL, email: "email@test.com", token: "token", client: &http.Client{}}
+	start := time.Date(2019, 12, 20, 8, 0, 0, 0, time.Local)
+	if err := device.SetHoliday(1234, start, start.AddDate(0, 0, 7), 12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["locId"] != 1234.0 || values["locMode"] != "holiday" || values["holStart"] != "2019-12-20 08:00" ||
+		values["holEnd"] != "2019-12-27 08:00" || values["holTemp"] != "120" {
+		t.Errorf("bad holiday values: %v", values)
+	}
+	if err := device.CancelHoliday(1234); err != nil || values["locMode"] != "prog" || values["holStart"] != "-" {
+		t.Errorf("bad cancel values: %v %v", values, err)
+	}
+	if err := device.SetHoliday(1234, start, start, 12); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("invalid value error expected when end is not after start, actual: %v", err)
+	}
+}
+
+func TestDevice_Unauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	device := Device{graphqlUrl: server.URL, email: "email@test.com", token: "token", client: &http.Client{}}
+	if _, err := device.ListRooms(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("unauthorized error expected, actual: %v", err)
+	}
+}
+
+func TestParseRunMode(t *testing.T) {
+	if mode, err := ParseRunMode(" Prog"); err != nil || mode != RunModeProg {
+		t.Errorf("prog mode expected, actual: %v (%v)", mode, err)
+	}
+	if _, err := ParseRunMode("auto"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("invalid value error expected, actual: %v", err)
+	}
+}
+
+func TestRetrieveAccessToken_InvalidCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := fmt.Fprint(w, `{"status":{"result":"error"},"response":{"method":"userLogin","errorCode":4},"message":{"duration":"0.082"}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := retrieveAccesToken(&http.Client{}, server.URL, "email@test", "bad"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("invalid credentials error expected, actual: %v", err)
+	}
+}
+
+func TestRetrieveAccessToken_Retryable(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		body     string
+		expected error
+	}{
+		{http.StatusTooManyRequests, `{"message":"rate limited"}`, ErrRejected},
+		{http.StatusBadRequest, `bad request`, ErrRejected},
+		{http.StatusBadGateway, ``, ErrUnavailable},
+		{http.StatusOK, `<html></html>`, ErrRejected},
+		{http.StatusOK, `{"status":{"result":"success"}}`, ErrRejected},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			_, _ = fmt.Fprint(w, c.body)
+		}))
+		_, err := retrieveAccesToken(&http.Client{}, server.URL, "email@test", "secret")
+		server.Close()
+		if !errors.Is(err, c.expected) || errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("status %d %s: %v error expected, actual: %v", c.status, c.body, c.expected, err)
+		}
+	}
+}
+
+func TestDevice_RenewToken(t *testing.T) {
+	logins := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		_, err := fmt.Fprint(w, `{"status":{"result":"success"},"response":{"method":"userLogin","token":"newToken"}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("warmup-authorization") != "newToken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, err := fmt.Fprint(w, `{"data":{"user":{"currentLocation":{"id":1234,"name":"Home","rooms":[]}}},"status":"success"}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	device := Device{
+		apiUrl:     server.URL + "/login",
+		graphqlUrl: server.URL + "/graphql",
+		email:      "email@test.com",
+		password:   "password",
+		token:      "expiredToken",
+		client:     &http.Client{},
+	}
+	if _, err := device.ListRooms(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := device.ListRooms(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if logins != 1 {
+		t.Errorf("1 login expected, actual: %d", logins)
+	}
+}
+
+func TestDevice_LoginValid(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprint(w, `{"status":{"result":"error"},"response":{"method":"userLogin","errorCode":4}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var requests []string
+	device := Device{
+		apiUrl:     server.URL + "/login",
+		graphqlUrl: server.URL + "/graphql",
+		email:      "email@test.com",
+		password:   "password",
+		token:      "expiredToken",
+		client:     &http.Client{},
+		observer: func(method string, statusCode int, duration time.Duration) {
+			requests = append(requests, fmt.Sprintf("%s:%d", method, statusCode))
+		},
+	}
+	if !device.LoginValid() {
+		t.Errorf("login must be valid before token is refused")
+	}
+	if _, err := device.ListRooms(); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("invalid credentials error expected, actual: %v", err)
+	}
+	if device.LoginValid() {
+		t.Errorf("login must be invalid after failed login")
+	}
+	if fmt.Sprint(requests) != "[getRooms:401 userLogin:200]" {
+		t.Errorf("bad observed requests: %v", requests)
+	}
+}
+
+func TestDevice_LoginOnFirstRequest(t *testing.T) {
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, "login")
+		_, err := fmt.Fprint(w, `{"status":{"result":"success"},"response":{"method":"userLogin","token":"token"}}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, "getRooms")
+		_, err := fmt.Fprint(w, `{"data":{"user":{"currentLocation":{"id":1234,"name":"Home","rooms":[]}}},"status":"success"}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	device := NewClient("email@test.com", "password", nil)
+	device.apiUrl = server.URL + "/login"
+	device.graphqlUrl = server.URL + "/graphql"
+	if device.LoginValid() {
+		t.Errorf("login must not be valid before first request")
+	}
+	if _, err := device.ListRooms(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(requests) != "[login getRooms]" {
+		t.Errorf("login expected before first request, actual: %v", requests)
+	}
+}
+
+func TestDevice_Timeout(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	device := NewClient("email@test.com", "password", nil)
+	if device.client.Timeout != DefaultTimeout {
+		t.Errorf("default timeout expected, actual: %v", device.client.Timeout)
+	}
+	device.apiUrl = server.URL
+	device.client.Timeout = 10 * time.Millisecond
+	if _, err := device.ListRooms(); err == nil {
+		t.Errorf("error expected when api does not respond")
+	}
+}
+
+func TestDevice_CredentialsReadOnLogin(t *testing.T) {
+	var passwords []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Request struct {
+				Email    string `json:"email"`
+				Password string `json:"password"`
+			} `json:"request"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		passwords = append(passwords, body.Request.Email+":"+body.Request.Password)
+		_, err := fmt.Fprintf(w, `{"status":{"result":"success"},"response":{"method":"userLogin","token":"token%d"}}`, len(passwords))
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("warmup-authorization") != "token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, err := fmt.Fprint(w, `{"data":{"user":{"currentLocation":{"id":1234,"name":"Home","rooms":[]}}},"status":"success"}`)
+		if err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	password := "old"
+	device := NewClientWithCredentials(func() (string, string, error) {
+		return "email@test.com", password, nil
+	}, nil)
+	device.apiUrl = server.URL + "/login"
+	device.graphqlUrl = server.URL + "/graphql"
+
+	// First token is refused, password rotated in the meantime must be used to login again
+	device.authenticated(func(token string) error {
+		password = "new"
+		return nil
+	})
+	if _, err := device.ListRooms(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(passwords) != "[email@test.com:old email@test.com:new]" {
+		t.Errorf("credentials must be read on each login, actual: %v", passwords)
+	}
+}
@@ -1,72 +1,637 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	mqttdevice "warmup4ie2mqtt/mqtt_device"
 	"warmup4ie2mqtt/warmup4ie"
 )
 
-const DefaultClientId = "warmup4ie2zwave"
+const (
+	DefaultClientId        = "warmup4ie2zwave"
+	DefaultMessageExpiry   = 10 * time.Minute
+	DefaultShutdownTimeout = 10 * time.Second
+)
+
+// PayloadMode defines how room values are published to the broker
+type PayloadMode string
+
+const (
+	// One bare value per topic
+	PayloadTopics PayloadMode = "topics"
+	// One json document per room
+	PayloadJson PayloadMode = "json"
+	// Both per value topics and json document
+	PayloadBoth PayloadMode = "both"
+	// Homie 4.0 convention, a device per location and a node per room, topic base is the homie root topic
+	PayloadHomie PayloadMode = "homie"
+	// Domoticz json messages on domoticz in topic, for rooms mapped to domoticz devices
+	PayloadDomoticz PayloadMode = "domoticz"
+)
+
+func ParsePayloadMode(value string) (PayloadMode, error) {
+	switch mode := PayloadMode(strings.ToLower(value)); mode {
+	case PayloadTopics, PayloadJson, PayloadBoth, PayloadHomie, PayloadDomoticz:
+		return mode, nil
+	case "":
+		return PayloadTopics, nil
+	default:
+		return "", fmt.Errorf("invalid payload mode '%s', expected one of %s, %s, %s, %s, %s", value, PayloadTopics, PayloadJson, PayloadBoth, PayloadHomie, PayloadDomoticz)
+	}
+}
+
+// RoomState is the json document published for a room
+type RoomState struct {
+	Id                 int       `json:"id"`
+	Name               string    `json:"name"`
+	CurrentTemperature float32   `json:"current_temperature"`
+	TargetTemperature  float32   `json:"target_temperature"`
+	RunMode            string    `json:"run_mode"`
+	MinTemperature     *float32  `json:"min_temperature,omitempty"`
+	MaxTemperature     *float32  `json:"max_temperature,omitempty"`
+	Location           Location  `json:"location"`
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+type Location struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// label return state values other than timestamp and temperatures, used to detect changes
+func (s RoomState) label() string {
+	s.Timestamp = time.Time{}
+	s.CurrentTemperature, s.TargetTemperature = 0, 0
+	content, _ := json.Marshal(&s)
+	return string(content)
+}
+
+func NewRoomState(room *warmup4ie.Room, timestamp time.Time) *RoomState {
+	state := RoomState{
+		Id:                 room.Id,
+		Name:               room.Name,
+		CurrentTemperature: room.CurrentTemp.GetValue(),
+		TargetTemperature:  room.TargetTemp.GetValue(),
+		RunMode:            room.RunMode.String(),
+		Location:           Location{Id: room.LocationId, Name: room.LocationName},
+		Timestamp:          timestamp.UTC(),
+	}
+	if len(room.Thermostat4IES) > 0 {
+		minTemp := room.Thermostat4IES[0].MinTemp.GetValue()
+		maxTemp := room.Thermostat4IES[0].MaxTemp.GetValue()
+		state.MinTemperature = &minTemp
+		state.MaxTemperature = &maxTemp
+	}
+	return &state
+}
+
+// Monitor polls thermostat and publishes rooms values to mqtt broker
+type Monitor struct {
+	// Name of warmup account, used in logs and metrics
+	Name       string
+	Thermostat warmup4ie.Thermostat
+	Publisher  mqttdevice.Publisher
+	Topics     *TopicLayout
+	Payload    PayloadMode
+	// Interval between polls, replaced by Schedule when set
+	IdleTime time.Duration
+	Schedule *PollSchedule
+	// Publish only changed values when set
+	Changes *ChangeFilter
+	// Subscribe to command topics of rooms
+	Commands bool
+	// Expiry of published room values, only used with mqtt 5
+	MessageExpiry time.Duration
+	// Delay before retrying failed polls
+	Backoff Backoff
+	// Consecutive failures after which published values are flagged stale, 0 to disable
+	StaleAfter int
+	// Collect internal metrics when set
+	Metrics *Metrics
+	// Outputs receiving rooms and events besides the broker
+	Sinks []Sink
+	// Domoticz devices of rooms, used in domoticz payload mode
+	Domoticz *Domoticz
+	// Alert rules evaluated on each poll, disabled when nil
+	Alerts *Alerts
+	// Alert events not published on broker, published again on next poll
+	pendingAlerts []*Event
+	now           func() time.Time
+
+	mutex  sync.Mutex
+	status PollStatus
+	// Rooms of last poll by id
+	rooms         map[int]warmup4ie.Room
+	roomsTime     time.Time
+	subscriptions map[string]bool
+	// Description of homie devices published by device id
+	homieDescribed map[string]string
+	// Commands being applied, waited on shutdown
+	inflight sync.WaitGroup
+	stopping bool
+	// Time of the last applied command, notified on commandApplied
+	lastCommand    time.Time
+	commandApplied chan struct{}
+	// Settings applied before next poll
+	pending      *Settings
+	reconfigured chan struct{}
+}
 
 func MonitorDevice(t warmup4ie.Thermostat, p mqttdevice.Publisher, topicBase string, idleTime time.Duration) {
-	var token MQTT.Token
+	m := Monitor{Thermostat: t, Publisher: p, Topics: DefaultTopicLayout(topicBase), Payload: PayloadTopics, IdleTime: idleTime}
+	if err := m.Run(context.Background()); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// Run poll thermostat until ctx is cancelled or an unrecoverable error occurs, failed polls are retried with backoff.
+// The current poll and commands being applied are completed before returning on cancellation.
+func (m *Monitor) Run(ctx context.Context) error {
+	defer m.stop()
 	for {
-		if rooms, err := t.ListRooms(); err != nil {
-			log.Fatalf("%+v\n", token.Error())
+		m.applySettings()
+		var delay time.Duration
+		start := time.Now()
+		err := m.poll()
+		if m.Metrics != nil {
+			m.Metrics.ObservePoll(m.Name, time.Since(start), err)
+		}
+		if err != nil {
+			failures := m.recordFailure(err, m.timestamp())
+			if IsUnrecoverable(err) {
+				return err
+			}
+			delay = m.Backoff.Delay(failures)
+			log.Printf("%spoll failed %d times, retry in %v: %v\n", m.logPrefix(), failures, delay, err)
 		} else {
-			for _, room := range *rooms {
-				topic := fmt.Sprintf("%s/%s/temperature/floor", topicBase, strings.ToLower(room.Name))
-				p.Publish(topic, fmt.Sprintf("%.1f", room.CurrentTemp.GetValue()))
-				topic = fmt.Sprintf("%s/%s/temperature/floor/target", topicBase, strings.ToLower(room.Name))
-				p.Publish(topic, fmt.Sprintf("%.1f", room.TargetTemp.GetValue()))
+			m.recordSuccess(m.timestamp())
+			delay = m.nextPoll()
+		}
+		if !m.wait(ctx, delay) {
+			return nil
+		}
+	}
+}
+
+// wait delay before next poll, next poll is anticipated when a command is applied.
+// Return false if ctx is cancelled.
+func (m *Monitor) wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer func() { timer.Stop() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-m.reconfiguredChan():
+			return true
+		case <-m.applied():
+			if next := m.nextPoll(); next < delay {
+				timer.Stop()
+				timer = time.NewTimer(next)
 			}
+		case <-timer.C:
+			return true
 		}
-		time.Sleep(idleTime)
 	}
 }
 
-func main() {
-	var mqttBroker, qos, clientId, topicBase, wEmail, wPassword string
-	setDefaultValueFromEnv(&clientId, "MQTT_CLIENT_ID", DefaultClientId)
-	setDefaultValueFromEnv(&mqttBroker, "MQTT_BROKER", "tcp://127.0.0.1:1883")
-	setDefaultValueFromEnv(&qos, "MQTT_QOS", "0")
-	mqttQos, err := strconv.Atoi(qos)
+// nextPoll return delay before next poll after a successful one
+func (m *Monitor) nextPoll() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Schedule == nil {
+		return m.IdleTime
+	}
+	return m.Schedule.Next(m.timestamp(), m.lastCommand)
+}
+
+// pollInterval return regular interval between polls at time now
+func (m *Monitor) pollInterval(now time.Time) time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Schedule == nil {
+		return m.IdleTime
+	}
+	return m.Schedule.IntervalAt(now)
+}
+
+// stop refuse new commands and wait for the ones being applied
+func (m *Monitor) stop() {
+	m.mutex.Lock()
+	m.stopping = true
+	m.mutex.Unlock()
+	m.inflight.Wait()
+	if m.Payload == PayloadHomie {
+		m.publishHomieDisconnected()
+	}
+}
+
+func (m *Monitor) poll() error {
+	rooms, err := m.Thermostat.ListRooms()
+	if err != nil {
+		return err
+	}
+	previous := m.updateRooms(*rooms)
+	if m.Commands {
+		// Rooms are still published, subscriptions that failed are retried on next poll
+		if err := m.subscribeCommands(*rooms); err != nil {
+			log.Printf("%sunable to subscribe to commands: %v\n", m.logPrefix(), err)
+		}
+	}
+	timestamp := m.timestamp()
+	for _, event := range roomEvents(m.Name, previous, *rooms, timestamp) {
+		m.writeEvent(event)
+	}
+	if len(m.pendingAlerts) > 0 {
+		if err := m.publishPendingAlerts(); err != nil {
+			m.sinkError(mqttSink{m}, err)
+		}
+	}
+	if m.Alerts != nil {
+		for _, event := range m.Alerts.Evaluate(m.Name, *rooms, timestamp) {
+			m.writeEvent(event)
+		}
+	}
+	m.writeRooms(&RoomSnapshot{Account: m.Name, Rooms: *rooms, Previous: previous, Timestamp: timestamp})
+	return nil
+}
+
+// publishRooms publish rooms of a poll to broker with the payload mode
+func (m *Monitor) publishRooms(rooms []warmup4ie.Room, timestamp time.Time) error {
+	if m.Changes != nil {
+		m.Changes.StartPoll(timestamp)
+	}
+	if m.Payload == PayloadHomie {
+		return m.publishHomie(rooms)
+	}
+	if m.Payload == PayloadDomoticz {
+		return m.publishDomoticz(rooms)
+	}
+	for i := range rooms {
+		room := &rooms[i]
+		if err := m.publishRoom(room, timestamp); err != nil {
+			if !errors.Is(err, ErrInvalidTopic) {
+				return err
+			}
+			// The topics of this room can't be built on next poll either, other rooms are still published
+			log.Printf("%sroom skipped: %v\n", m.logPrefix(), err)
+		}
+	}
+	return nil
+}
+
+// publishRoom publish values of room with topics or json payload
+func (m *Monitor) publishRoom(room *warmup4ie.Room, timestamp time.Time) error {
+	if m.Payload != PayloadJson {
+		if err := m.publishValues(room); err != nil {
+			return err
+		}
+	}
+	if m.Payload == PayloadJson || m.Payload == PayloadBoth {
+		if err := m.publishState(room, timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) publishValues(room *warmup4ie.Room) error {
+	topic, err := m.Topics.CurrentTopic(room)
+	if err != nil {
+		return err
+	}
+	if err := m.publishTemperature(topic, room, room.CurrentTemp); err != nil {
+		return err
+	}
+	topic, err = m.Topics.TargetTopic(room)
 	if err != nil {
-		log.Panicf("invalid mqtt qos value: %v", qos)
-	}
-	_, mqttRetain := os.LookupEnv("MQTT_RETAIN")
-
-	publisher := mqttdevice.PahoMqttPublisher{}
-	flag.StringVar(&publisher.Uri, "mqtt-broker", mqttBroker, "Broker Uri, use MQTT_BROKER env if arg not set")
-	flag.StringVar(&publisher.Username, "mqtt-username", os.Getenv("MQTT_USERNAME"), "Broker Username, use MQTT_USERNAME env if arg not set")
-	flag.StringVar(&publisher.Password, "mqtt-password", os.Getenv("MQTT_PASSWORD"), "Broker Password, MQTT_PASSWORD env if args not set")
-	flag.StringVar(&publisher.ClientId, "mqtt-client-id", clientId, "Mqtt client id, use MQTT_CLIENT_ID env if args not set")
-	flag.IntVar(&publisher.Oos, "mqtt-qos", mqttQos, "Qos to pusblish message, use MQTT_QOS env if arg not set")
-	flag.StringVar(&topicBase, "mqtt-topic-base", os.Getenv("MQTT_TOPIC_BASE"), "Mqtt topic prefix, use MQTT_TOPIC_BASE if args not set")
-	flag.BoolVar(&publisher.Retain, "mqtt-retain", mqttRetain, "Retain mqtt message, if not set, true if MQTT_RETAIN env variable is set")
-	flag.StringVar(&wEmail, "warmup-email", os.Getenv("WARMUP_EMAIL"), "Warmup email used to logon, use WARMUP_USERNAME env if arg not set")
-	flag.StringVar(&wPassword, "warmup-password", os.Getenv("WARMUP_PASSWORD"), "Warmup password used to logon, use WARMUP_PASSWORD env if arg not set")
-
-	flag.Parse()
-	if len(os.Args) <= 1 {
-		flag.PrintDefaults()
+		return err
+	}
+	return m.publishTemperature(topic, room, room.TargetTemp)
+}
+
+func (m *Monitor) publishTemperature(topic string, room *warmup4ie.Room, temp warmup4ie.Temperature) error {
+	if m.Changes != nil && !m.Changes.ShouldPublish(topic, "", temp.GetValue()) {
+		return nil
+	}
+	properties := m.roomProperties(room, "text/plain")
+	properties.UserProperties["unit"] = "°C"
+	return m.publishChange(topic, fmt.Sprintf("%.1f", temp.GetValue()), properties)
+}
+
+func (m *Monitor) publishState(room *warmup4ie.Room, timestamp time.Time) error {
+	state := NewRoomState(room, timestamp)
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to marshal state of room %s: %w", room.Name, err)
+	}
+	topic, err := m.Topics.StateTopic(room)
+	if err != nil {
+		return err
+	}
+	if m.Changes != nil && !m.Changes.ShouldPublish(topic, state.label(), state.CurrentTemperature, state.TargetTemperature) {
+		return nil
+	}
+	return m.publishChange(topic, string(payload), m.roomProperties(room, "application/json"))
+}
+
+// publishChange publish value accepted by change filter, value is published again on next poll if publication fails
+func (m *Monitor) publishChange(topic string, payload string, properties *mqttdevice.Properties) error {
+	err := m.publish(topic, payload, properties)
+	if err != nil && m.Changes != nil {
+		m.Changes.Forget(topic)
+	}
+	return err
+}
+
+// roomProperties return mqtt 5 properties of messages about room
+func (m *Monitor) roomProperties(room *warmup4ie.Room, contentType string) *mqttdevice.Properties {
+	return &mqttdevice.Properties{
+		MessageExpiry: m.messageExpiry(),
+		ContentType:   contentType,
+		UserProperties: map[string]string{
+			"room_id":     strconv.Itoa(room.Id),
+			"location_id": strconv.Itoa(room.LocationId),
+		},
+	}
+}
+
+// publish message with properties if supported by publisher
+func (m *Monitor) publish(topic string, payload string, properties *mqttdevice.Properties) error {
+	var err error
+	if p, ok := m.Publisher.(mqttdevice.PropertiesPublisher); ok && properties != nil {
+		err = p.PublishWithProperties(topic, payload, properties)
+	} else {
+		err = m.Publisher.Publish(topic, payload)
+	}
+	if err != nil && m.Metrics != nil {
+		m.Metrics.PublishError()
+	}
+	return err
+}
+
+func (m *Monitor) logPrefix() string {
+	if m.Name == "" {
+		return ""
+	}
+	return "account " + m.Name + ": "
+}
+
+func (m *Monitor) timestamp() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+func main() {
+	if len(os.Args) > 1 && IsSubcommand(os.Args[1]) {
+		os.Exit(RunSubcommand(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) <= 1 && os.Getenv("CONFIG_FILE") == "" {
+		fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		DefaultConfig().registerFlags(fs)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nSubcommands, run with [flags] before arguments, -json to print json:\n")
+		for _, command := range Subcommands {
+			fmt.Fprintf(fs.Output(), "  %s\n    \t%s\n", strings.TrimSpace(command.Name+" "+command.Args), command.Usage)
+		}
 		os.Exit(1)
 	}
+	config, configFile, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	topics, err := config.TopicLayout(config.Topics.Base)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	availabilityTopic, err := topics.AvailabilityTopic()
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	metrics := NewMetrics()
+	accounts := config.AccountList()
+	devices := make([]warmup4ie.Thermostat, len(accounts))
+	accountSettings := make([]*Settings, len(accounts))
+	for i, account := range accounts {
+		if accountSettings[i], err = config.Settings(account); err != nil {
+			log.Panicf("%v", err)
+		}
+		devices[i] = account.NewClient(metrics.RequestObserver(account.Name))
+	}
+	availability := &mqttdevice.Availability{Topic: availabilityTopic}
+	if payload, _ := ParsePayloadMode(config.Publish.Payload); payload == PayloadHomie {
+		// Homie devices are set lost by the last will instead of the availability topic
+		var layouts []*TopicLayout
+		for _, settings := range accountSettings {
+			layouts = append(layouts, settings.Topics)
+		}
+		if will := homieWill(devices, layouts); will != nil {
+			availability = will
+		}
+	}
+	publisher, err := config.NewPublisher(availability)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	if config.Queue.Size > 0 {
+		if publisher, err = mqttdevice.NewQueuedPublisher(publisher, config.Queue.Size, config.Queue.File); err != nil {
+			log.Panicf("%v", err)
+		}
+	}
+	domoticz := config.NewDomoticz()
+	if notifier, ok := publisher.(mqttdevice.BrokerConnectionNotifier); ok {
+		notifier.OnBrokerConnect(metrics.BrokerConnected)
+	} else if notifier, ok := publisher.(mqttdevice.ConnectionNotifier); ok {
+		notifier.OnConnect(metrics.Connected)
+	}
+	sinks, err := config.NewSinks(metrics)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	var stream *RoomStream
+	if config.API.Listen != "" {
+		stream = NewRoomStream()
+		sinks = append(sinks, stream)
+	}
 
+	var monitors []*Monitor
+	for i, account := range accounts {
+		settings := accountSettings[i]
+		monitors = append(monitors, &Monitor{
+			Name:       account.Name,
+			Thermostat: devices[i],
+			Publisher:  publisher,
+			Topics:     settings.Topics,
+			Payload:    settings.Payload,
+			IdleTime:   settings.Schedule.Interval,
+			Schedule:   settings.Schedule,
+			Changes:    settings.Changes,
+			Commands:   settings.Commands,
+			// Expire values after several missed polls
+			MessageExpiry: settings.MessageExpiry,
+			Backoff:       settings.Backoff,
+			StaleAfter:    settings.StaleAfter,
+			Metrics:       metrics,
+			Sinks:         sinks,
+			Domoticz:      domoticz,
+			Alerts:        settings.Alerts,
+		})
+	}
 	publisher.Connect()
-	defer publisher.Close()
-	device, err := warmup4ie.NewDevice(wEmail, wPassword)
+	muxes := make(map[string]*http.ServeMux)
+	if config.HTTP.Listen != "" {
+		health := NewHealthHandler(monitors, config.HTTP.ReadyPollIntervals)
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		mux.Handle("/readyz", health)
+		mux.Handle("/metrics", metrics)
+		muxes[config.HTTP.Listen] = mux
+	}
+	if config.API.Listen != "" {
+		mux, ok := muxes[config.API.Listen]
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[config.API.Listen] = mux
+		}
+		api := NewAPIHandler(monitors, config.API.KeyProvider())
+		mux.Handle("/locations", api)
+		mux.Handle("/rooms", api)
+		mux.Handle("/rooms/", api)
+		mux.Handle("/events", NewStreamHandler(monitors, stream))
+	}
+	for listen, mux := range muxes {
+		server := &http.Server{Addr: listen, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("http listener %s stopped: %v\n", server.Addr, err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	done := runMonitors(ctx, monitors)
+	closers := append([]func(){publisher.Close}, RunSinks(ctx, sinks)...)
+
+	reloads := make(chan struct{}, 1)
+	if configFile != "" {
+		go WatchConfig(ctx, configFile, DefaultConfigCheckInterval, func() { reloads <- struct{}{} })
+	}
+	for {
+		select {
+		case <-done:
+			for _, closeOutput := range closers {
+				closeOutput()
+			}
+			log.Panicf("all accounts stopped on unrecoverable errors\n")
+		case <-reloads:
+			config = reload(monitors, config)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				config = reload(monitors, config)
+				continue
+			}
+			log.Printf("%v received, shutting down\n", sig)
+			cancel()
+			shutdown(done, config.ShutdownTimeout, closers...)
+			return
+		}
+	}
+}
+
+// runMonitors run each monitor concurrently, the returned channel is closed when all monitors are stopped.
+// A monitor stopped on an unrecoverable error doesn't stop the other ones.
+func runMonitors(ctx context.Context, monitors []*Monitor) <-chan struct{} {
+	var wg sync.WaitGroup
+	for _, monitor := range monitors {
+		wg.Add(1)
+		go func(m *Monitor) {
+			defer wg.Done()
+			if err := m.Run(ctx); err != nil {
+				log.Printf("%sstopped on unrecoverable error: %v\n", m.logPrefix(), err)
+			}
+		}(monitor)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// reload configuration and apply settings that don't require a restart, current configuration is kept if the new one is invalid
+func reload(monitors []*Monitor, current *Config) *Config {
+	config, _, err := LoadConfig(os.Args[1:])
 	if err != nil {
-		log.Panicf("unable to connect to warmup server: %v\n", err)
+		log.Printf("configuration not reloaded: %v\n", err)
+		return current
+	}
+	if changed := config.KeepRestartSettings(current); len(changed) > 0 {
+		log.Printf("changes of %s settings are ignored until restart\n", strings.Join(changed, ", "))
+	}
+	accounts := make(map[string]AccountConfig)
+	for _, account := range config.AccountList() {
+		accounts[account.Name] = account
+	}
+	settings := make(map[*Monitor]*Settings)
+	for _, monitor := range monitors {
+		account, ok := accounts[monitor.Name]
+		if !ok {
+			// Removed account keeps running until restart
+			continue
+		}
+		if settings[monitor], err = config.Settings(account); err != nil {
+			log.Printf("configuration not reloaded: %v\n", err)
+			return current
+		}
+	}
+	for monitor, s := range settings {
+		monitor.Reconfigure(s)
+	}
+	return config
+}
+
+// shutdown wait for monitors to complete their current poll then close outputs, gives up after timeout
+func shutdown(done <-chan struct{}, timeout time.Duration, closers ...func()) {
+	deadline := time.After(timeout)
+	select {
+	case <-done:
+	case <-deadline:
+		log.Printf("monitors not stopped after %v, exit\n", timeout)
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		for _, closeOutput := range closers {
+			closeOutput()
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-deadline:
+		log.Printf("outputs not closed after %v, exit\n", timeout)
 	}
-	MonitorDevice(device, &publisher, topicBase, 3*time.Minute)
 }
 
 func setDefaultValueFromEnv(value *string, key string, defaultValue string) {
@@ -76,3 +641,36 @@ func setDefaultValueFromEnv(value *string, key string, defaultValue string) {
 		*value = defaultValue
 	}
 }
+
+func floatFromEnv(key string, defaultValue float64) (float64, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value '%s': %w", key, os.Getenv(key), err)
+	}
+	return value, nil
+}
+
+func intFromEnv(key string, defaultValue int) (int, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value '%s': %w", key, os.Getenv(key), err)
+	}
+	return value, nil
+}
+
+func durationFromEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value '%s': %w", key, os.Getenv(key), err)
+	}
+	return value, nil
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	mqttdevice "warmup4ie2mqtt/mqtt_device"
 	"warmup4ie2mqtt/warmup4ie"
 )
 
@@ -61,6 +65,17 @@ func (t *thermostatMock) ListRooms() (*[]warmup4ie.Room, error) {
 	}, nil
 }
 
+func (t *thermostatMock) SetTargetTemperature(roomId int, temperature float32) error {
+	return nil
+}
+
+func (t *thermostatMock) SetRunMode(roomId int, mode warmup4ie.RunMode) error {
+	if mode != warmup4ie.RunModeProg && mode != warmup4ie.RunModeFixed {
+		return fmt.Errorf("unable to set mode %v: %w", mode, warmup4ie.ErrUnsupportedRunMode)
+	}
+	return nil
+}
+
 type fakePublisher struct {
 	msg map[string]interface{}
 }
@@ -73,8 +88,25 @@ func (f fakePublisher) Close() {
 	panic("implement me")
 }
 
-func (f fakePublisher) Publish(topic string, payload interface{}) {
+// fakePublisherMutex guard messages of fake publishers used by monitors running in background
+var fakePublisherMutex sync.Mutex
+
+func (f fakePublisher) Publish(topic string, payload interface{}) error {
+	fakePublisherMutex.Lock()
+	defer fakePublisherMutex.Unlock()
 	f.msg[topic] = payload
+	return nil
+}
+
+// published return a copy of published messages
+func (f fakePublisher) published() map[string]interface{} {
+	fakePublisherMutex.Lock()
+	defer fakePublisherMutex.Unlock()
+	msg := make(map[string]interface{}, len(f.msg))
+	for topic, payload := range f.msg {
+		msg[topic] = payload
+	}
+	return msg
 }
 
 func TestMonitorDevice(t *testing.T) {
@@ -84,8 +116,9 @@ func TestMonitorDevice(t *testing.T) {
 
 	go MonitorDevice(&th, p, "room", 1*time.Millisecond)
 	time.Sleep(10 * time.Millisecond)
-	if len(p.msg) != 4 {
-		t.Errorf("4 messages are expected, pusblished: %d", len(p.msg))
+	msg := p.published()
+	if len(msg) != 4 {
+		t.Errorf("4 messages are expected, pusblished: %d", len(msg))
 	}
 
 	expectedTopic := map[string]string{
@@ -95,11 +128,182 @@ func TestMonitorDevice(t *testing.T) {
 		"room/room2/temperature/floor/target": "25.0",
 	}
 	for topic, temp := range expectedTopic {
-		if p.msg[topic] == nil {
+		if msg[topic] == nil {
 			t.Errorf("No temperature published on topic %s", topic)
 		}
-		if p.msg[topic] != temp {
-			t.Errorf("Bad temperature for topic %s. expected %s but received %v", topic, temp, p.msg[topic])
+		if msg[topic] != temp {
+			t.Errorf("Bad temperature for topic %s. expected %s but received %v", topic, temp, msg[topic])
+		}
+	}
+}
+
+func TestMonitor_JsonPayload(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  p,
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadJson,
+		now:        func() time.Time { return time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC) },
+	}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.msg) != 2 {
+		t.Errorf("2 messages are expected, published: %d", len(p.msg))
+	}
+
+	expected := `{"id":1,"name":"Room1","current_temperature":19,"target_temperature":22,"run_mode":"fixed","location":{"id":0,"name":""},"timestamp":"2019-11-02T10:30:00Z"}`
+	if p.msg["room/room1/state"] != expected {
+		t.Errorf("bad state for room1,\nexpected: %v\n  actual: %v", expected, p.msg["room/room1/state"])
+	}
+}
+
+func TestMonitor_BothPayload(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m := Monitor{Thermostat: &thermostatMock{}, Publisher: p, Topics: DefaultTopicLayout("room"), Payload: PayloadBoth}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, topic := range []string{"room/room2/temperature/floor", "room/room2/temperature/floor/target", "room/room2/state"} {
+		if p.msg[topic] == nil {
+			t.Errorf("no message published on topic %s", topic)
+		}
+	}
+}
+
+func TestParsePayloadMode(t *testing.T) {
+	if mode, err := ParsePayloadMode(""); err != nil || mode != PayloadTopics {
+		t.Errorf("topics mode expected by default, actual: %v (%v)", mode, err)
+	}
+	if mode, err := ParsePayloadMode("JSON"); err != nil || mode != PayloadJson {
+		t.Errorf("json mode expected, actual: %v (%v)", mode, err)
+	}
+	if _, err := ParsePayloadMode("xml"); err == nil {
+		t.Errorf("error expected for invalid payload mode")
+	}
+}
+
+func TestMonitor_OnlyChanges(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  p,
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadBoth,
+		Changes:    NewChangeFilter(0.1, time.Hour),
+	}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.msg) != 6 {
+		t.Errorf("6 messages are expected on first poll, published: %d", len(p.msg))
+	}
+
+	for topic := range p.msg {
+		delete(p.msg, topic)
+	}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.msg) != 0 {
+		t.Errorf("no message expected for unchanged values, published: %v", p.msg)
+	}
+}
+
+type fakePropertiesPublisher struct {
+	fakePublisher
+	properties map[string]*mqttdevice.Properties
+}
+
+func (f fakePropertiesPublisher) PublishWithProperties(topic string, payload interface{}, properties *mqttdevice.Properties) error {
+	f.msg[topic] = payload
+	f.properties[topic] = properties
+	return nil
+}
+
+func TestMonitor_Properties(t *testing.T) {
+	p := fakePropertiesPublisher{fakePublisher{msg: make(map[string]interface{})}, make(map[string]*mqttdevice.Properties)}
+	m := Monitor{
+		Thermostat:    &thermostatMock{},
+		Publisher:     p,
+		Topics:        DefaultTopicLayout("room"),
+		Payload:       PayloadBoth,
+		MessageExpiry: 10 * time.Minute,
+	}
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	props := p.properties["room/room2/temperature/floor"]
+	if props == nil || props.MessageExpiry != 10*time.Minute || props.UserProperties["room_id"] != "2" || props.UserProperties["unit"] != "°C" {
+		t.Errorf("bad properties for temperature: %+v", props)
+	}
+	props = p.properties["room/room2/state"]
+	if props == nil || props.ContentType != "application/json" || props.UserProperties["room_id"] != "2" {
+		t.Errorf("bad properties for state: %+v", props)
+	}
+
+	m.handleModeCommand(2, &mqttdevice.Message{Topic: "room/room2/mode/set", Payload: []byte("prog"), ResponseTopic: "client/response", CorrelationData: []byte("42")})
+	props = p.properties["client/response"]
+	if props == nil || string(props.CorrelationData) != "42" {
+		t.Errorf("correlation data expected in command response: %+v", props)
+	}
+}
+
+// wildcardThermostat has a room with a wildcard in its name
+type wildcardThermostat struct {
+	thermostatMock
+}
+
+func (t *wildcardThermostat) ListRooms() (*[]warmup4ie.Room, error) {
+	rooms, _ := t.thermostatMock.ListRooms()
+	(*rooms)[0].Name = "Room#1"
+	return rooms, nil
+}
+
+func TestMonitor_InvalidRoomTopic(t *testing.T) {
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m := Monitor{Thermostat: &wildcardThermostat{}, Publisher: p, Topics: DefaultTopicLayout("room"), Payload: PayloadBoth}
+	if err := m.poll(); err != nil {
+		t.Fatalf("a room with invalid topics must not fail the poll: %v", err)
+	}
+	if p.msg["room/room2/temperature/floor"] != "20.0" || p.msg["room/room2/state"] == nil {
+		t.Errorf("other rooms must be published, published: %v", p.msg)
+	}
+	for topic := range p.msg {
+		if strings.Contains(topic, "#") {
+			t.Errorf("no message expected on invalid topic %s", topic)
 		}
 	}
 }
+
+type failingPublisher struct {
+	fakePublisher
+}
+
+func (f failingPublisher) Publish(topic string, payload interface{}) error {
+	return fmt.Errorf("not connected")
+}
+
+func TestMonitor_PublishError(t *testing.T) {
+	m := Monitor{
+		Thermostat: &thermostatMock{},
+		Publisher:  failingPublisher{},
+		Topics:     DefaultTopicLayout("room"),
+		Payload:    PayloadTopics,
+		Changes:    NewChangeFilter(0.1, time.Hour),
+	}
+	if err := m.poll(); err != nil {
+		t.Errorf("publish errors must not fail the poll: %v", err)
+	}
+
+	p := fakePublisher{msg: make(map[string]interface{})}
+	m.Publisher = p
+	if err := m.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.msg["room/room1/temperature/floor"] != "19.0" {
+		t.Errorf("value not published must be published on next poll, published: %v", p.msg)
+	}
+}
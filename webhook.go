@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DefaultWebhookMaxRetries = 3
+	DefaultWebhookRetryDelay = time.Second
+	DefaultWebhookTimeout    = 10 * time.Second
+	// Maximum number of events waiting for delivery, new events are dropped when full
+	DefaultWebhookQueueSize = 100
+	// Header of the hex encoded HMAC-SHA256 of the body, prefixed by sha256=
+	WebhookSignatureHeader = "X-Warmup-Signature-256"
+)
+
+// WebhookEvents are all the events that can be sent to webhooks
+var WebhookEvents = []string{EventTargetTemperature, EventRunMode, EventReachability, EventPollFailed, EventPollRecovered, EventAlert}
+
+// Webhook posts events to an url, failed deliveries are retried in background
+type Webhook struct {
+	Name string
+	Url  string
+	// Events sent to url, all events when empty
+	Events []string
+	// Go template of the json body, json of the event when nil
+	Body *template.Template
+	// Return secret used to sign body, body is not signed when it returns an empty secret
+	Secret     func() (string, error)
+	Headers    map[string]string
+	MaxRetries int
+	RetryDelay time.Duration
+	// Count failed deliveries when set
+	Metrics *Metrics
+	client  *http.Client
+
+	mutex sync.Mutex
+	queue chan *Event
+}
+
+// ParseWebhookBody parse go template of webhook body, json function encodes a value in json
+func ParseWebhookBody(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			content, err := json.Marshal(value)
+			return string(content), err
+		},
+	}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+	return t, nil
+}
+
+// Accept return true if event is sent to the webhook
+func (w *Webhook) Accept(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Send queue event for delivery, event is dropped and an error returned when queue is full
+func (w *Webhook) Send(event *Event) error {
+	if !w.Accept(event.Event) {
+		return nil
+	}
+	select {
+	case w.queueChan() <- event:
+		return nil
+	default:
+		return fmt.Errorf("webhook %s: queue full, %s event dropped", w.Name, event.Event)
+	}
+}
+
+// Run deliver queued events until ctx is cancelled, remaining events are delivered by Close
+func (w *Webhook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queueChan():
+			if err := w.deliverRetry(ctx, event, w.MaxRetries); err != nil {
+				log.Printf("webhook %s: %s event dropped: %v\n", w.Name, event.Event, err)
+				w.sinkError()
+			}
+		}
+	}
+}
+
+// Close deliver queued events without retry
+func (w *Webhook) Close() {
+	for {
+		select {
+		case event := <-w.queueChan():
+			if err := w.deliver(context.Background(), event); err != nil {
+				log.Printf("webhook %s: %s event dropped: %v\n", w.Name, event.Event, err)
+				w.sinkError()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// sinkError count a failed delivery under the name of webhooks sink
+func (w *Webhook) sinkError() {
+	if w.Metrics != nil {
+		w.Metrics.SinkError(Webhooks{}.Name())
+	}
+}
+
+func (w *Webhook) deliverRetry(ctx context.Context, event *Event, retries int) error {
+	delay := w.retryDelay()
+	for attempt := 0; ; attempt++ {
+		err := w.deliver(ctx, event)
+		if err == nil || !isWebhookRetryable(err) || attempt >= retries {
+			return err
+		}
+		log.Printf("webhook %s: delivery failed, retry in %v: %v\n", w.Name, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) deliver(ctx context.Context, event *Event) error {
+	body, err := w.body(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		request.Header.Set(key, value)
+	}
+	if w.Secret != nil {
+		secret, err := w.Secret()
+		if err != nil {
+			return err
+		}
+		if secret != "" {
+			request.Header.Set(WebhookSignatureHeader, "sha256="+Sign(secret, body))
+		}
+	}
+	response, err := w.httpClient().Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to post event: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return &WebhookError{StatusCode: response.StatusCode}
+	}
+	return nil
+}
+
+// WebhookError is the error of an event rejected by the webhook url
+type WebhookError struct {
+	StatusCode int
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("event rejected with status %d", e.StatusCode)
+}
+
+// isWebhookRetryable return false when the url rejected the event with a client error other than timeout or rate limit, it would be rejected again
+func isWebhookRetryable(err error) bool {
+	e, ok := err.(*WebhookError)
+	return !ok || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// body return json body of event, built from template when set
+func (w *Webhook) body(event *Event) ([]byte, error) {
+	if w.Body == nil {
+		return json.Marshal(event)
+	}
+	var body bytes.Buffer
+	if err := w.Body.Execute(&body, event); err != nil {
+		return nil, fmt.Errorf("unable to build body: %w", err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("body template doesn't produce valid json: %s", body.String())
+	}
+	return body.Bytes(), nil
+}
+
+// Sign return hex encoded HMAC-SHA256 of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) queueChan() chan *Event {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.queue == nil {
+		w.queue = make(chan *Event, DefaultWebhookQueueSize)
+	}
+	return w.queue
+}
+
+func (w *Webhook) httpClient() *http.Client {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.client == nil {
+		w.client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	return w.client
+}
+
+func (w *Webhook) retryDelay() time.Duration {
+	if w.RetryDelay <= 0 {
+		return DefaultWebhookRetryDelay
+	}
+	return w.RetryDelay
+}
+
+// Webhooks send events to all webhooks
+type Webhooks []*Webhook
+
+// Send queue event for delivery to webhooks accepting it, return the errors of webhooks with a full queue
+func (h Webhooks) Send(event *Event) error {
+	var failures []string
+	for _, w := range h {
+		if err := w.Send(event); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Run deliver events of all webhooks until ctx is cancelled
+func (h Webhooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range h {
+		wg.Add(1)
+		go func(w *Webhook) {
+			defer wg.Done()
+			w.Run(ctx)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (h Webhooks) Close() {
+	for _, w := range h {
+		w.Close()
+	}
+}
+
+func (h Webhooks) Name() string {
+	return "webhooks"
+}
+
+// WriteRooms does nothing, webhooks only receive events
+func (h Webhooks) WriteRooms(snapshot *RoomSnapshot) error {
+	return nil
+}
+
+// WriteEvent queue event for delivery to webhooks accepting it
+func (h Webhooks) WriteEvent(event *Event) error {
+	return h.Send(event)
+}
+
+// validateWebhookEvent return an error if event is unknown
+func validateWebhookEvent(event string) error {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event '%s', expected one of %s", event, strings.Join(WebhookEvents, ", "))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"warmup4ie2mqtt/warmup4ie"
+)
+
+type webhookServer struct {
+	mutex      sync.Mutex
+	statuses   []int
+	bodies     []string
+	signatures []string
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	s.bodies = append(s.bodies, string(body))
+	s.signatures = append(s.signatures, r.Header.Get(WebhookSignatureHeader))
+}
+
+func (s *webhookServer) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func TestRoomEvents(t *testing.T) {
+	rooms, _ := (&thermostatMock{}).ListRooms()
+	timestamp := time.Date(2019, 11, 2, 10, 30, 0, 0, time.UTC)
+	if events := roomEvents("home", nil, *rooms, timestamp); len(events) != 0 {
+		t.Errorf("no event expected on first poll, actual: %v", events)
+	}
+
+	previous := map[int]warmup4ie.Room{1: (*rooms)[0], 3: {Id: 3, Name: "Room3"}}
+	changed := append([]warmup4ie.Room(nil), *rooms...)
+	changed[0].TargetTemp = warmup4ie.Temperature{RawTemperature: 200}
+	changed[0].RunMode = warmup4ie.RunModeProg
+	events := roomEvents("home", previous, changed, timestamp)
+	expected := []struct {
+		event    string
+		room     int
+		previous interface{}
+		value    interface{}
+	}{
+		{EventTargetTemperature, 1, float32(22), float32(20)},
+		{EventRunMode, 1, "fixed", "prog"},
+		{EventReachability, 2, false, true},
+		{EventReachability, 3, true, false},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("%d events expected, actual: %v", len(expected), events)
+	}
+	for i, e := range expected {
+		event := events[i]
+		if event.Event != e.event || event.Room.Id != e.room || event.Previous != e.previous || event.Value != e.value || event.Account != "home" {
+			t.Errorf("bad event %d, expected: %+v, actual: %+v", i, e, event)
+		}
+	}
+}
+
+func TestWebhook_Deliver(t *testing.T) {
+	server := webhookServer{statuses: []int{http.StatusServiceUnavailable}}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	body, err := ParseWebhookBody("test", `{"text": {{json (printf "%s changed on %s" .Event .Room.Name)}}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := Webhook{
+		Name:       "test",
+		Url:        httpServer.URL,
+		Events:     []string{EventRunMode},
+		Body:       body,
+		Secret:     secretProvider("secret", ""),
+		MaxRetries: 1,
+		RetryDelay: time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Send(&Event{Event: EventPollFailed})
+	w.Send(&Event{Event: EventRunMode, Room: &RoomState{Name: "Room1"}})
+	deadline := time.Now().Add(time.Second)
+	for len(server.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("event must be delivered after a retry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bodies := server.received()
+	if len(bodies) != 1 || bodies[0] != `{"text": "run_mode changed on Room1"}` {
+		t.Errorf("only run mode event expected with templated body, actual: %v", bodies)
+	}
+	if server.signatures[0] != "sha256="+Sign("secret", []byte(bodies[0])) {
+		t.Errorf("bad signature: %s", server.signatures[0])
+	}
+}
+
+func TestWebhooks_Errors(t *testing.T) {
+	server := webhookServer{statuses: []int{http.StatusBadRequest}}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	w := Webhook{Name: "test", Url: httpServer.URL, Metrics: NewMetrics()}
+	hooks := Webhooks{&w}
+	for i := 0; i < DefaultWebhookQueueSize; i++ {
+		if err := hooks.WriteEvent(&Event{Event: EventPollFailed}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := hooks.WriteEvent(&Event{Event: EventPollFailed}); err == nil {
+		t.Errorf("error expected when queue is full")
+	}
+
+	w.Close()
+	if len(server.received()) != DefaultWebhookQueueSize-1 {
+		t.Errorf("queued events must be delivered on close, actual: %d", len(server.received()))
+	}
+	if w.Metrics.sinkErrors["webhooks"] != 1 {
+		t.Errorf("failed delivery must be counted as sink error, actual: %v", w.Metrics.sinkErrors)
+	}
+}
+
+func TestMonitor_PollFailedEvent(t *testing.T) {
+	server := webhookServer{}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	m, _ := newCommandMonitor()
+	m.Name = "home"
+	webhooks := Webhooks{{Url: httpServer.URL}}
+	m.Sinks = []Sink{webhooks}
+
+	now := m.timestamp()
+	m.recordFailure(warmup4ie.ErrUnavailable, now)
+	m.recordFailure(warmup4ie.ErrUnavailable, now)
+	m.recordSuccess(now)
+	webhooks.Close()
+	var events []Event
+	for _, body := range server.received() {
+		var event Event
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			t.Fatalf("unable to decode event %s: %v", body, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || events[0].Event != EventPollFailed || events[0].Error == "" || events[1].Event != EventPollRecovered {
+		t.Errorf("poll failed and recovered events expected once, actual: %+v", events)
+	}
+}
+
+func TestWebhook_DeliverRejected(t *testing.T) {
+	server := webhookServer{statuses: []int{http.StatusBadRequest, http.StatusTooManyRequests}}
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+	w := Webhook{Name: "test", Url: httpServer.URL, RetryDelay: time.Millisecond}
+
+	if err := w.deliverRetry(context.Background(), &Event{Event: EventPollFailed}, 3); err == nil {
+		t.Errorf("rejected event must not be retried")
+	}
+	if len(server.received()) != 0 {
+		t.Errorf("no event expected, actual: %v", server.received())
+	}
+	if err := w.deliverRetry(context.Background(), &Event{Event: EventPollFailed}, 3); err != nil {
+		t.Errorf("rate limited event must be retried: %v", err)
+	}
+	if len(server.received()) != 1 {
+		t.Errorf("event must be delivered after a retry, actual: %v", server.received())
+	}
+}